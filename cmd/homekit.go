@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli"
@@ -13,8 +15,11 @@ import (
 
 	"homekit-ng/homekit"
 	"homekit-ng/homekit/broker"
+	"homekit-ng/homekit/derive"
 	"homekit-ng/homekit/device"
+	"homekit-ng/homekit/persist"
 	"homekit-ng/homekit/publish"
+	"homekit-ng/homekit/tm"
 )
 
 const (
@@ -44,7 +49,9 @@ func run(path string) error {
 		return err
 	}
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	log, err := newLogger(cfg.Logging)
 	if err != nil {
 		return err
@@ -64,13 +71,65 @@ func run(path string) error {
 		}
 	}
 
-	memoryBroker := broker.NewMemoryBroker()
+	memoryBroker, err := broker.NewMemoryBroker(&cfg.MemoryBroker)
+	if err != nil {
+		return err
+	}
 
-	hub := homekit.NewHub(log.Sugar())
+	hub, err := homekit.NewHub(cfg.Telemetry, log.Sugar())
+	if err != nil {
+		return err
+	}
 	hub.AddBroker(memoryBroker)
-	hub.AddBroker(broker.NewUDPBroker(cfg.Broker.Port, log.Sugar()))
+	if len(cfg.Brokers) == 0 {
+		hub.AddBroker(broker.NewUDPBroker(&cfg.Broker, log.Sugar()))
+	}
+	for _, brokerConfig := range cfg.Brokers {
+		if brokerConfig.Disabled {
+			log.Sugar().Infof("skipping disabled %s broker", brokerConfig.Type)
+			continue
+		}
+
+		b, err := broker.NewBroker(brokerConfig, log.Sugar())
+		if err != nil {
+			return err
+		}
+
+		hub.AddBroker(b)
+	}
+
+	derivedTopics, err := derive.NewEngine(cfg.Derived, hub.Telemetries(), log.Sugar())
+	if err != nil {
+		return err
+	}
+
+	var persister *persist.Persister
+	if cfg.Persist.Enabled() {
+		persister = persist.NewPersister(&cfg.Persist, hub.Telemetries(), log.Sugar())
+		if err := persister.Restore(); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sig)
+
+		select {
+		case <-ctx.Done():
+		case v := <-sig:
+			log.Sugar().Infof("received %s, shutting down", v)
+			cancel()
+		}
+	}()
 
 	wg, ctx := errgroup.WithContext(ctx)
+	if persister != nil {
+		wg.Go(func() error {
+			return persister.Run(ctx)
+		})
+	}
 	wg.Go(func() error {
 		timer := time.NewTicker(5 * time.Second)
 		defer timer.Stop()
@@ -80,19 +139,24 @@ func run(path string) error {
 			case <-ctx.Done():
 				return ctx.Err()
 			case <-timer.C:
+				var telemetries []*tm.Telemetry
 				for mac := range cfg.Tracking.Devices {
 					isUp := 0.0
 					if deviceTracker.IsUp(mac) {
 						isUp = 1.0
 					}
-					memoryBroker.Add(fmt.Sprintf("/home/activity/%s", mac), isUp)
+					telemetries = append(telemetries, tm.NewTelemetry(fmt.Sprintf("/home/activity/%s", mac), tm.Float(isUp)))
 				}
+				memoryBroker.AddMulti(telemetries)
 			}
 		}
 	})
 	wg.Go(func() error {
 		return deviceTracker.Run(ctx)
 	})
+	wg.Go(func() error {
+		return derivedTopics.Run(ctx)
+	})
 	wg.Go(func() error {
 		writer := publish.NewInfluxDBMetricsWriter(&cfg.Influx, hub.Telemetries(), log.Sugar())
 		return writer.Run(ctx)
@@ -101,7 +165,11 @@ func run(path string) error {
 		return hub.Run(ctx)
 	})
 
-	return wg.Wait()
+	if err := wg.Wait(); err != context.Canceled {
+		return err
+	}
+
+	return nil
 }
 
 func main() {
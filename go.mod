@@ -4,6 +4,8 @@ go 1.12
 
 require (
 	github.com/brutella/hc v1.2.0
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/google/gopacket v1.1.17
 	github.com/influxdata/influxdb1-client v0.0.0-20190402204710-8ff2fc3824fc
 	github.com/pkg/errors v0.8.1 // indirect
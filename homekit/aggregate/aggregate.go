@@ -0,0 +1,262 @@
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	FuncMin   = "min"
+	FuncMax   = "max"
+	FuncMean  = "mean"
+	FuncLast  = "last"
+	FuncCount = "count"
+)
+
+// Config describes aggregation of topics matching the pattern.
+type Config struct {
+	// Pattern is an MQTT-style topic pattern.
+	Pattern string
+	// Funcs is a list of aggregate functions: "min", "max", "mean", "last"
+	// and "count".
+	Funcs []string
+}
+
+type rule struct {
+	pattern *tm.Pattern
+	funcs   []string
+}
+
+// window accumulates samples of a single series between flushes.
+type window struct {
+	topic  tm.Topic
+	labels tm.Labels
+	funcs  []string
+
+	min   float64
+	max   float64
+	sum   float64
+	n     int
+	count int
+	last  tm.TelemetryValue
+}
+
+func newWindow(telemetry *tm.Telemetry, funcs []string) *window {
+	return &window{
+		topic:  telemetry.Topic,
+		labels: telemetry.Labels,
+		funcs:  funcs,
+		min:    math.Inf(1),
+		max:    math.Inf(-1),
+	}
+}
+
+func (m *window) add(value tm.TelemetryValue) {
+	m.count++
+	m.last = value
+
+	// Non-numeric values only contribute to "last" and "count".
+	if v, ok := value.Numeric(); ok && value.Kind() != tm.KindString {
+		m.min = math.Min(m.min, v)
+		m.max = math.Max(m.max, v)
+		m.sum += v
+		m.n++
+	}
+}
+
+// merge accounts the samples of the newer window of the same series.
+func (m *window) merge(other *window) {
+	m.min = math.Min(m.min, other.min)
+	m.max = math.Max(m.max, other.max)
+	m.sum += other.sum
+	m.n += other.n
+	m.count += other.count
+	m.last = other.last
+}
+
+func (m *window) telemetries() []*tm.Telemetry {
+	var telemetries []*tm.Telemetry
+	for _, fn := range m.funcs {
+		var value tm.TelemetryValue
+		switch fn {
+		case FuncMin:
+			if m.n == 0 {
+				continue
+			}
+			value = tm.Float(m.min)
+		case FuncMax:
+			if m.n == 0 {
+				continue
+			}
+			value = tm.Float(m.max)
+		case FuncMean:
+			if m.n == 0 {
+				continue
+			}
+			value = tm.Float(m.sum / float64(m.n))
+		case FuncLast:
+			value = m.last
+		case FuncCount:
+			value = tm.Int(int64(m.count))
+		}
+
+		telemetries = append(telemetries, &tm.Telemetry{
+			Topic:  m.topic + "_" + fn,
+			Value:  value,
+			Labels: m.labels,
+		})
+	}
+
+	return telemetries
+}
+
+// Aggregator computes per-series aggregates of the telemetry put into the
+// storage over windows delimited by Flush calls.
+type Aggregator struct {
+	rules   []*rule
+	storage *tm.TelemetryStorage
+
+	mu      sync.Mutex
+	windows map[string]*window
+	// flushed are the windows returned by the last Flush and not committed
+	// yet.
+	flushed map[string]*window
+}
+
+func NewAggregator(cfgs []*Config, storage *tm.TelemetryStorage) (*Aggregator, error) {
+	rules := make([]*rule, len(cfgs))
+	for id, cfg := range cfgs {
+		pattern, err := tm.CompilePattern(cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fn := range cfg.Funcs {
+			switch fn {
+			case FuncMin, FuncMax, FuncMean, FuncLast, FuncCount:
+			default:
+				return nil, fmt.Errorf("unknown aggregate function: %s", fn)
+			}
+		}
+
+		rules[id] = &rule{
+			pattern: pattern,
+			funcs:   cfg.Funcs,
+		}
+	}
+
+	m := &Aggregator{
+		rules:   rules,
+		storage: storage,
+		windows: map[string]*window{},
+		flushed: map[string]*window{},
+	}
+
+	return m, nil
+}
+
+// Run accumulates the telemetry until the context is cancelled.
+func (m *Aggregator) Run(ctx context.Context) error {
+	if len(m.rules) == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// Aggregates are approximate anyway, so dropping telemetry that does not
+	// fit is better than stalling the ingestion.
+	subscription, err := m.storage.Subscribe(tm.MultiLevelWildcard, tm.SubscribeOptions{
+		Capacity: 1024,
+		Policy:   tm.DropOldest,
+	})
+	if err != nil {
+		return err
+	}
+	defer subscription.Unsubscribe()
+
+	metrics.Default.CounterFunc("aggregate/dropped", nil, subscription.Dropped)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case telemetry := <-subscription.C():
+			m.Add(telemetry)
+		}
+	}
+}
+
+// Add accounts the telemetry in the current window of its series.
+func (m *Aggregator) Add(telemetry *tm.Telemetry) {
+	funcs := m.funcs(telemetry.Topic)
+	if len(funcs) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := telemetry.Key()
+
+	w, ok := m.windows[key]
+	if !ok {
+		w = newWindow(telemetry, funcs)
+		m.windows[key] = w
+	}
+
+	w.add(telemetry.Value)
+}
+
+// funcs returns the functions of the first rule matching the topic.
+func (m *Aggregator) funcs(topic tm.Topic) []string {
+	for _, rule := range m.rules {
+		if rule.pattern.Match(topic) {
+			return rule.funcs
+		}
+	}
+
+	return nil
+}
+
+// Flush closes the current window, returning the aggregates as telemetry
+// with "_<func>" suffixed topics, like "/home/temp_max", and the labels of
+// the aggregated series.
+//
+// The closed window is kept until Commit is called, so if the aggregates
+// could not be written, the next Flush merges it with the following window
+// instead of losing its samples.
+//
+// Series without samples in the window are omitted.
+func (m *Aggregator) Flush() []*tm.Telemetry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, w := range m.windows {
+		if flushed, ok := m.flushed[key]; ok {
+			flushed.merge(w)
+		} else {
+			m.flushed[key] = w
+		}
+	}
+	m.windows = map[string]*window{}
+
+	var telemetries []*tm.Telemetry
+	for _, w := range m.flushed {
+		telemetries = append(telemetries, w.telemetries()...)
+	}
+
+	return telemetries
+}
+
+// Commit discards the window closed by the last Flush after its aggregates
+// have been written.
+func (m *Aggregator) Commit() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flushed = map[string]*window{}
+}
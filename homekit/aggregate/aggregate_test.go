@@ -0,0 +1,111 @@
+package aggregate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+func flushed(telemetries []*tm.Telemetry) map[string]tm.TelemetryValue {
+	values := map[string]tm.TelemetryValue{}
+	for _, telemetry := range telemetries {
+		values[telemetry.Key()] = telemetry.Value
+	}
+
+	return values
+}
+
+func TestAggregator(t *testing.T) {
+	aggregator, err := NewAggregator([]*Config{
+		{Pattern: "/home/+/temp", Funcs: []string{FuncMin, FuncMax, FuncMean, FuncLast, FuncCount}},
+		{Pattern: "/home/#", Funcs: []string{FuncCount}},
+	}, tm.NewTelemetryStorage())
+	require.NoError(t, err)
+
+	kitchen := tm.NewTelemetry("/home/kitchen/temp", tm.Float(22))
+	kitchen.Labels = tm.Labels{"room": "kitchen"}
+
+	for _, telemetry := range []*tm.Telemetry{
+		tm.NewTelemetry("/home/bathroom/temp", tm.Float(21)),
+		tm.NewTelemetry("/home/bathroom/temp", tm.Float(27)),
+		tm.NewTelemetry("/home/bathroom/temp", tm.Float(24)),
+		kitchen,
+		tm.NewTelemetry("/home/door", tm.Bool(true)),
+		tm.NewTelemetry("/home/door", tm.Bool(false)),
+		tm.NewTelemetry("/outdoor/temp", tm.Float(10)),
+	} {
+		aggregator.Add(telemetry)
+	}
+
+	values := flushed(aggregator.Flush())
+	assert.Equal(t, map[string]tm.TelemetryValue{
+		"/home/bathroom/temp_min":                tm.Float(21),
+		"/home/bathroom/temp_max":                tm.Float(27),
+		"/home/bathroom/temp_mean":               tm.Float(24),
+		"/home/bathroom/temp_last":               tm.Float(24),
+		"/home/bathroom/temp_count":              tm.Int(3),
+		"/home/kitchen/temp_min{room=kitchen}":   tm.Float(22),
+		"/home/kitchen/temp_max{room=kitchen}":   tm.Float(22),
+		"/home/kitchen/temp_mean{room=kitchen}":  tm.Float(22),
+		"/home/kitchen/temp_last{room=kitchen}":  tm.Float(22),
+		"/home/kitchen/temp_count{room=kitchen}": tm.Int(1),
+		"/home/door_count":                       tm.Int(2),
+	}, values)
+
+	// The window is reset after committing.
+	aggregator.Commit()
+	assert.Empty(t, aggregator.Flush())
+}
+
+func TestAggregatorFlushWithoutCommit(t *testing.T) {
+	aggregator, err := NewAggregator([]*Config{
+		{Pattern: "#", Funcs: []string{FuncMin, FuncMax, FuncLast, FuncCount}},
+	}, tm.NewTelemetryStorage())
+	require.NoError(t, err)
+
+	aggregator.Add(tm.NewTelemetry("/home/temp", tm.Float(21)))
+	aggregator.Add(tm.NewTelemetry("/home/temp", tm.Float(25)))
+	aggregator.Flush()
+
+	// The failed window is merged into the next one.
+	aggregator.Add(tm.NewTelemetry("/home/temp", tm.Float(23)))
+	aggregator.Add(tm.NewTelemetry("/home/mode", tm.String("heat")))
+
+	assert.Equal(t, map[string]tm.TelemetryValue{
+		"/home/temp_min":   tm.Float(21),
+		"/home/temp_max":   tm.Float(25),
+		"/home/temp_last":  tm.Float(23),
+		"/home/temp_count": tm.Int(3),
+		"/home/mode_last":  tm.String("heat"),
+		"/home/mode_count": tm.Int(1),
+	}, flushed(aggregator.Flush()))
+
+	aggregator.Commit()
+	assert.Empty(t, aggregator.Flush())
+}
+
+func TestAggregatorNonNumeric(t *testing.T) {
+	aggregator, err := NewAggregator([]*Config{
+		{Pattern: "#", Funcs: []string{FuncMax, FuncLast, FuncCount}},
+	}, tm.NewTelemetryStorage())
+	require.NoError(t, err)
+
+	aggregator.Add(tm.NewTelemetry("/home/mode", tm.String("heat")))
+	aggregator.Add(tm.NewTelemetry("/home/mode", tm.String("cool")))
+
+	assert.Equal(t, map[string]tm.TelemetryValue{
+		"/home/mode_last":  tm.String("cool"),
+		"/home/mode_count": tm.Int(2),
+	}, flushed(aggregator.Flush()))
+}
+
+func TestNewAggregatorInvalid(t *testing.T) {
+	_, err := NewAggregator([]*Config{{Pattern: "/home/#/temp", Funcs: []string{FuncMax}}}, tm.NewTelemetryStorage())
+	assert.Error(t, err)
+
+	_, err = NewAggregator([]*Config{{Pattern: "/home/#", Funcs: []string{"median"}}}, tm.NewTelemetryStorage())
+	assert.Error(t, err)
+}
@@ -0,0 +1,186 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"homekit-ng/homekit/tm"
+)
+
+// UDPSourceConfig describes which topics a datagram source is allowed to
+// write.
+type UDPSourceConfig struct {
+	// Name of the source, substituted for "{name}" in the Prefix.
+	Name string
+	// Addrs are source addresses or CIDRs, like "192.168.1.10" or
+	// "192.168.1.0/24".
+	Addrs []string
+	// Sensors are ids of authenticated sensors, see UDPAuthConfig.
+	Sensors []string
+	// Prefix is prepended to every topic, like "/sensors/{name}", optional.
+	Prefix string
+	// Topics are patterns of allowed topics, after the prefix is applied.
+	//
+	// Empty means that all topics are allowed.
+	Topics []string
+}
+
+type sourceRule struct {
+	name    string
+	nets    []*net.IPNet
+	sensors map[string]bool
+	prefix  string
+	topics  []*tm.Pattern
+}
+
+func newSourceRule(cfg *UDPSourceConfig) (*sourceRule, error) {
+	if len(cfg.Addrs) == 0 && len(cfg.Sensors) == 0 {
+		return nil, fmt.Errorf("source %s must have either addresses or sensors", cfg.Name)
+	}
+
+	rule := &sourceRule{
+		name:    cfg.Name,
+		sensors: map[string]bool{},
+	}
+
+	for _, addr := range cfg.Addrs {
+		ipNet, err := parseSourceAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address of source %s: %v", cfg.Name, err)
+		}
+		rule.nets = append(rule.nets, ipNet)
+	}
+
+	for _, sensor := range cfg.Sensors {
+		rule.sensors[sensor] = true
+	}
+
+	if len(cfg.Prefix) != 0 {
+		if strings.Contains(cfg.Prefix, "{name}") && len(cfg.Name) == 0 {
+			return nil, fmt.Errorf("source prefix %s requires a name", cfg.Prefix)
+		}
+
+		rule.prefix = strings.TrimSuffix(strings.Replace(cfg.Prefix, "{name}", cfg.Name, -1), tm.TopicSeparator)
+		if tm.IsWildcard(rule.prefix) {
+			return nil, fmt.Errorf("wildcards are not allowed in source prefix %s", rule.prefix)
+		}
+	}
+
+	for _, topic := range cfg.Topics {
+		pattern, err := tm.CompilePattern(topic)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic pattern of source %s: %v", cfg.Name, err)
+		}
+		rule.topics = append(rule.topics, pattern)
+	}
+
+	return rule, nil
+}
+
+func parseSourceAddr(addr string) (*net.IPNet, error) {
+	if strings.IndexByte(addr, '/') >= 0 {
+		_, ipNet, err := net.ParseCIDR(addr)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (m *sourceRule) Match(ip net.IP, sensor string) bool {
+	if len(sensor) != 0 && m.sensors[sensor] {
+		return true
+	}
+
+	for _, ipNet := range m.nets {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply prepends the prefix to the topic and checks whether the result is
+// allowed.
+func (m *sourceRule) Apply(telemetry *tm.Telemetry) error {
+	if len(m.prefix) != 0 {
+		telemetry.Topic = m.prefix + tm.TopicSeparator + strings.TrimPrefix(telemetry.Topic, tm.TopicSeparator)
+	}
+
+	if len(m.topics) == 0 {
+		return nil
+	}
+
+	for _, pattern := range m.topics {
+		if pattern.Match(telemetry.Topic) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("topic %s is not allowed for source %s", telemetry.Topic, m.name)
+}
+
+// sourceACL restricts topics datagram sources are allowed to write.
+//
+// Rules are checked in order and the first one matching the source applies.
+// Without rules any source may write any topic, otherwise sources not
+// matching any rule are rejected.
+type sourceACL struct {
+	rules []*sourceRule
+}
+
+func newSourceACL(cfgs []*UDPSourceConfig) (*sourceACL, error) {
+	acl := &sourceACL{}
+	for _, cfg := range cfgs {
+		rule, err := newSourceRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+
+	return acl, nil
+}
+
+// Filter applies the rule matching the source to the telemetry values,
+// returning the allowed ones and errors describing the rest.
+func (m *sourceACL) Filter(addr net.Addr, sensor string, values []*tm.Telemetry) ([]*tm.Telemetry, []error) {
+	if len(m.rules) == 0 {
+		return values, nil
+	}
+
+	var ip net.IP
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ip = udpAddr.IP
+	}
+
+	for _, rule := range m.rules {
+		if !rule.Match(ip, sensor) {
+			continue
+		}
+
+		var allowed []*tm.Telemetry
+		var errs []error
+		for _, telemetry := range values {
+			if err := rule.Apply(telemetry); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			allowed = append(allowed, telemetry)
+		}
+
+		return allowed, errs
+	}
+
+	return nil, []error{fmt.Errorf("source %s is not allowed", addr)}
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+func udpAddr(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func topicsOf(values []*tm.Telemetry) []string {
+	var topics []string
+	for _, telemetry := range values {
+		topics = append(topics, telemetry.Topic)
+	}
+
+	return topics
+}
+
+func TestSourceACLAllowsAllWithoutRules(t *testing.T) {
+	acl, err := newSourceACL(nil)
+	require.NoError(t, err)
+
+	values, errs := acl.Filter(udpAddr("10.0.0.1"), "", []*tm.Telemetry{tm.NewTelemetry("/home/temp", tm.Float(21))})
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"/home/temp"}, topicsOf(values))
+}
+
+func TestSourceACLTopics(t *testing.T) {
+	acl, err := newSourceACL([]*UDPSourceConfig{
+		{Name: "thermostat", Addrs: []string{"192.168.1.10"}, Topics: []string{"/home/thermostat/#"}},
+		{Name: "lan", Addrs: []string{"192.168.1.0/24", "fd00::/8"}, Topics: []string{"/home/+/temp"}},
+	})
+	require.NoError(t, err)
+
+	newValues := func() []*tm.Telemetry {
+		return []*tm.Telemetry{
+			tm.NewTelemetry("/home/thermostat/target", tm.Float(22)),
+			tm.NewTelemetry("/home/kitchen/temp", tm.Float(21)),
+		}
+	}
+
+	values, errs := acl.Filter(udpAddr("192.168.1.10"), "", newValues())
+	assert.Len(t, errs, 1)
+	assert.Equal(t, []string{"/home/thermostat/target"}, topicsOf(values))
+
+	values, errs = acl.Filter(udpAddr("192.168.1.20"), "", newValues())
+	assert.Len(t, errs, 1)
+	assert.Equal(t, []string{"/home/kitchen/temp"}, topicsOf(values))
+
+	values, errs = acl.Filter(udpAddr("fd00::1"), "", newValues())
+	assert.Len(t, errs, 1)
+	assert.Equal(t, []string{"/home/kitchen/temp"}, topicsOf(values))
+
+	values, errs = acl.Filter(udpAddr("10.0.0.1"), "", newValues())
+	assert.Len(t, errs, 1)
+	assert.Empty(t, values)
+}
+
+func TestSourceACLPrefix(t *testing.T) {
+	acl, err := newSourceACL([]*UDPSourceConfig{
+		{Name: "kitchen", Addrs: []string{"192.168.1.10"}, Sensors: []string{"kitchen-esp"}, Prefix: "/sensors/{name}/"},
+	})
+	require.NoError(t, err)
+
+	values, errs := acl.Filter(udpAddr("192.168.1.10"), "", []*tm.Telemetry{tm.NewTelemetry("/temp", tm.Float(21))})
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"/sensors/kitchen/temp"}, topicsOf(values))
+
+	// Authenticated sensors match regardless of their address.
+	values, errs = acl.Filter(udpAddr("10.0.0.1"), "kitchen-esp", []*tm.Telemetry{tm.NewTelemetry("humidity", tm.Float(40))})
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"/sensors/kitchen/humidity"}, topicsOf(values))
+}
+
+func TestSourceACLInvalid(t *testing.T) {
+	for _, cfg := range []*UDPSourceConfig{
+		{Name: "empty"},
+		{Name: "addr", Addrs: []string{"192.168.1.300"}},
+		{Name: "cidr", Addrs: []string{"192.168.1.0/33"}},
+		{Addrs: []string{"192.168.1.10"}, Prefix: "/sensors/{name}"},
+		{Name: "+", Addrs: []string{"192.168.1.10"}, Prefix: "/sensors/{name}"},
+		{Name: "topics", Addrs: []string{"192.168.1.10"}, Topics: []string{"/home/#/temp"}},
+	} {
+		_, err := newSourceACL([]*UDPSourceConfig{cfg})
+		assert.Error(t, err, cfg.Name)
+	}
+}
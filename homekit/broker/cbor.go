@@ -0,0 +1,248 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"homekit-ng/homekit/tm"
+)
+
+// cborMajorMap is the major type of CBOR maps, stored in the top three bits
+// of the initial byte.
+const cborMajorMap = 5
+
+// cborDecoder decodes the compact binary format for constrained sensors.
+//
+// The payload is a CBOR map of topics to values, like
+// {1: 21.5, "/home/door": true}. Topics are either text strings with
+// optional labels, like "/home/temp{room=kitchen}", or unsigned integer ids
+// from the dictionary, see UDPConfig.TopicIDs, which take a single byte for
+// ids below 24.
+//
+// Values are booleans, numbers or text strings. Integers and floats of any
+// precision are decoded into float values, like JSON numbers, so the field
+// type in InfluxDB does not depend on how the sensor encodes a reading;
+// NaN and infinities are rejected.
+// The value may also be the [value, timestamp] array with the sensor-side
+// timestamp, which is either Unix seconds or the epoch-based date/time tag,
+// accepted according to the TimestampConfig.
+type cborDecoder struct {
+	timestamps *TimestampConfig
+	topics     map[uint64]*cborTopic
+}
+
+type cborTopic struct {
+	topic  tm.Topic
+	labels tm.Labels
+}
+
+func newCBORDecoder(timestamps *TimestampConfig, topicIDs map[uint64]string) (*cborDecoder, error) {
+	topics := map[uint64]*cborTopic{}
+	for id, series := range topicIDs {
+		topic, labels, err := parseCBORTopic(series)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic of id %d: %v", id, err)
+		}
+
+		topics[id] = &cborTopic{
+			topic:  topic,
+			labels: labels,
+		}
+	}
+
+	decoder := &cborDecoder{
+		timestamps: timestamps,
+		topics:     topics,
+	}
+
+	return decoder, nil
+}
+
+func (m *cborDecoder) Decode(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error) {
+	size, offset, err := cborMapHeader(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec := cbor.NewDecoder(bytes.NewReader(payload[offset:]))
+
+	var tmVec []*tm.Telemetry
+	var errs []*PairError
+	for id := 0; id < size; id++ {
+		start := offset + dec.NumBytesRead()
+
+		var key, value cbor.RawMessage
+		if err := dec.Decode(&key); err != nil {
+			return nil, nil, fmt.Errorf("invalid CBOR: %v", err)
+		}
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, fmt.Errorf("invalid CBOR: %v", err)
+		}
+
+		telemetry, err := m.decodeMember(key, value, now)
+		if err != nil {
+			raw := hex.EncodeToString(payload[start : offset+dec.NumBytesRead()])
+			errs = append(errs, &PairError{Index: id, Raw: raw, Err: err})
+			continue
+		}
+
+		tmVec = append(tmVec, telemetry)
+	}
+
+	if offset+dec.NumBytesRead() != len(payload) {
+		return nil, nil, fmt.Errorf("unexpected data after CBOR map")
+	}
+
+	return tmVec, errs, nil
+}
+
+func (m *cborDecoder) decodeMember(key, value []byte, now time.Time) (*tm.Telemetry, error) {
+	var k interface{}
+	if err := cbor.Unmarshal(key, &k); err != nil {
+		return nil, fmt.Errorf("invalid telemetry topic: %v", err)
+	}
+
+	var topic tm.Topic
+	var labels tm.Labels
+	switch k := k.(type) {
+	case uint64:
+		t, ok := m.topics[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown topic id %d", k)
+		}
+		topic, labels = t.topic, t.labels
+	case string:
+		var err error
+		topic, labels, err = parseCBORTopic(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid telemetry topic: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("expected topic string or id, got %T", k)
+	}
+
+	var v interface{}
+	if err := cbor.Unmarshal(value, &v); err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", topic, err)
+	}
+
+	timestamp := now
+	if pair, ok := v.([]interface{}); ok {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("expected [value, timestamp] array of %s", topic)
+		}
+
+		sensorTimestamp, err := cborTimestamp(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of %s: %v", topic, err)
+		}
+
+		timestamp, err = m.timestamps.resolve(sensorTimestamp, now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of %s: %v", topic, err)
+		}
+
+		v = pair[0]
+	}
+
+	telemetryValue, err := cborValue(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", topic, err)
+	}
+
+	telemetry := &tm.Telemetry{
+		Topic:     topic,
+		Value:     telemetryValue,
+		Labels:    labels,
+		Timestamp: timestamp,
+	}
+
+	return telemetry, nil
+}
+
+func parseCBORTopic(series string) (tm.Topic, tm.Labels, error) {
+	topic, labels, err := tm.ParseSeries(series)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(topic) == 0 {
+		return "", nil, fmt.Errorf("empty topic")
+	}
+	if tm.IsWildcard(topic) {
+		return "", nil, fmt.Errorf("wildcards are not allowed in topic %s", topic)
+	}
+
+	return topic, labels, nil
+}
+
+func cborValue(v interface{}) (tm.TelemetryValue, error) {
+	switch v := v.(type) {
+	case bool:
+		return tm.Bool(v), nil
+	case uint64:
+		return tm.Float(float64(v)), nil
+	case int64:
+		return tm.Float(float64(v)), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return tm.TelemetryValue{}, fmt.Errorf("non-finite float value %v", v)
+		}
+		return tm.Float(v), nil
+	case string:
+		return tm.String(v), nil
+	default:
+		return tm.TelemetryValue{}, fmt.Errorf("expected a scalar value, got %T", v)
+	}
+}
+
+func cborTimestamp(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case uint64:
+		if v > math.MaxInt64 {
+			return time.Time{}, fmt.Errorf("timestamp %d overflows int64", v)
+		}
+		return time.Unix(int64(v), 0), nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case time.Time:
+		return v, nil
+	default:
+		return time.Time{}, fmt.Errorf("expected Unix seconds or epoch-based date/time, got %T", v)
+	}
+}
+
+// cborMapHeader returns the number of members of the definite-length CBOR
+// map the payload starts with and the length of its header.
+func cborMapHeader(payload []byte) (int, int, error) {
+	if !isCBOR(payload) {
+		return 0, 0, fmt.Errorf("expected CBOR map")
+	}
+
+	info := payload[0] & 0x1f
+	switch {
+	case info < 24:
+		return int(info), 1, nil
+	case info == 24 && len(payload) >= 2:
+		return int(payload[1]), 2, nil
+	case info == 25 && len(payload) >= 3:
+		return int(binary.BigEndian.Uint16(payload[1:])), 3, nil
+	case info == 31:
+		return 0, 0, fmt.Errorf("indefinite-length CBOR maps are not supported")
+	default:
+		return 0, 0, fmt.Errorf("invalid CBOR map header")
+	}
+}
+
+// isCBOR checks whether the payload starts with a CBOR map, which never
+// happens with text formats, since such initial bytes are UTF-8
+// continuation bytes.
+func isCBOR(payload []byte) bool {
+	return len(payload) != 0 && payload[0]>>5 == cborMajorMap
+}
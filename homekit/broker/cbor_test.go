@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+// cborMap encodes key-value pairs as the CBOR map, keeping their order.
+func cborMap(t *testing.T, pairs ...interface{}) []byte {
+	payload := []byte{0xa0 | byte(len(pairs)/2)}
+	for _, v := range pairs {
+		b, err := cbor.Marshal(v)
+		require.NoError(t, err)
+		payload = append(payload, b...)
+	}
+
+	return payload
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	topicIDs := map[uint64]string{
+		1:   "/home/temp",
+		2:   "/home/hum{room=kitchen}",
+		300: "/home/door",
+	}
+
+	decoder, err := NewDecoder(FormatCBOR, &TimestampConfig{MaxSkew: time.Hour}, topicIDs)
+	require.NoError(t, err)
+
+	payload := cborMap(t,
+		1, 21.5,
+		2, []interface{}{40, 1559999000},
+		300, true,
+		"/home/counter{sensor=a1}", -42,
+		"/home/firmware", "v1.2",
+		7, 1,
+		"/home/+", 1,
+		"/home/bad", []interface{}{1, 2, 3},
+		"/home/big", uint64(1<<63),
+		[]byte("/home/bytes"), 1,
+		"/home/nan", math.NaN(),
+		"/home/inf", float32(math.Inf(1)),
+		"/home/ninf", cbor.RawMessage{0xf9, 0xfc, 0x00},
+	)
+
+	values, errs, err := decoder.Decode(payload, now)
+	require.NoError(t, err)
+
+	assert.Equal(t, []*tm.Telemetry{
+		{Topic: "/home/temp", Value: tm.Float(21.5), Timestamp: now},
+		{Topic: "/home/hum", Value: tm.Float(40), Labels: tm.Labels{"room": "kitchen"}, Timestamp: time.Unix(1559999000, 0)},
+		{Topic: "/home/door", Value: tm.Bool(true), Timestamp: now},
+		{Topic: "/home/counter", Value: tm.Float(-42), Labels: tm.Labels{"sensor": "a1"}, Timestamp: now},
+		{Topic: "/home/firmware", Value: tm.String("v1.2"), Timestamp: now},
+		{Topic: "/home/big", Value: tm.Float(1 << 63), Timestamp: now},
+	}, values)
+
+	var indices []int
+	for _, err := range errs {
+		assert.NotEmpty(t, err.Raw)
+		indices = append(indices, err.Index)
+	}
+	assert.Equal(t, []int{5, 6, 7, 9, 10, 11, 12}, indices)
+	assert.Equal(t, "0701", errs[0].Raw)
+}
+
+func TestDecodeCBORAuto(t *testing.T) {
+	decoder, err := NewDecoder(FormatAuto, nil, map[uint64]string{1: "/home/temp"})
+	require.NoError(t, err)
+
+	values, errs, err := decoder.Decode(cborMap(t, 1, float32(21.5)), time.Now())
+	require.NoError(t, err)
+	require.Empty(t, errs)
+	require.Len(t, values, 1)
+
+	assert.Equal(t, "/home/temp", values[0].Topic)
+	assert.Equal(t, tm.Float(21.5), values[0].Value)
+}
+
+func TestDecodeMalformedCBOR(t *testing.T) {
+	decoder, err := NewDecoder(FormatCBOR, nil, nil)
+	require.NoError(t, err)
+
+	for name, payload := range map[string][]byte{
+		"not a map":       {0x82, 0x01, 0x02},
+		"empty":           {},
+		"truncated":       {0xa2, 0x01, 0x01},
+		"trailing data":   append(cborMap(t, "/home/temp", 1), 0x01),
+		"indefinite":      {0xbf, 0x01, 0x01, 0xff},
+		"truncated value": {0xa1, 0x01, 0xfb, 0x40},
+	} {
+		values, _, err := decoder.Decode(payload, time.Now())
+		assert.Error(t, err, name)
+		assert.Nil(t, values, name)
+	}
+}
+
+func TestNewCBORDecoderInvalidTopics(t *testing.T) {
+	for _, topic := range []string{"", "/home/+", "/home/temp{room}"} {
+		_, err := NewDecoder(FormatCBOR, nil, map[uint64]string{1: topic})
+		assert.Error(t, err, topic)
+	}
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"homekit-ng/homekit/tm"
+)
+
+type Broker interface {
+	Run(ctx context.Context, tm *tm.TelemetryStorage) error
+}
+
+// Config describes a broker as its type and type-specific arguments.
+type Config struct {
+	Type string      `json:"type"`
+	Args interface{} `json:"args"`
+	// Disabled brokers are skipped, keeping their configuration around.
+	Disabled bool `json:"disabled"`
+}
+
+// Validate checks the type and the arguments of the broker, which is useful
+// for disabled brokers, which are never constructed.
+func (m *Config) Validate() error {
+	_, err := m.decodeArgs()
+	return err
+}
+
+// NewBroker constructs the broker described by the config, validating its
+// arguments.
+func NewBroker(cfg *Config, log *zap.SugaredLogger) (Broker, error) {
+	args, err := cfg.decodeArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	switch args := args.(type) {
+	case *UDPConfig:
+		return NewUDPBroker(args, log), nil
+	case *HTTPConfig:
+		return NewHTTPBroker(args, log), nil
+	case *MQTTConfig:
+		return NewMQTTBroker(args, log), nil
+	case *MQTTServerConfig:
+		return NewMQTTServer(args, log), nil
+	case *LineProtocolConfig:
+		return NewLineProtocolBroker(args, log), nil
+	case *StatsDConfig:
+		return NewStatsDBroker(args, log), nil
+	case *GraphiteConfig:
+		return NewGraphiteBroker(args, log), nil
+	default:
+		panic(fmt.Sprintf("unexpected %T broker args", args))
+	}
+}
+
+// decodeArgs decodes and validates the arguments of the broker type.
+func (m *Config) decodeArgs() (validator, error) {
+	var args validator
+	switch m.Type {
+	case "udp":
+		args = &UDPConfig{}
+	case "http":
+		args = &HTTPConfig{}
+	case "mqtt":
+		args = &MQTTConfig{}
+	case "mqtt_server":
+		args = &MQTTServerConfig{}
+	case "line_protocol":
+		args = &LineProtocolConfig{}
+	case "statsd":
+		args = &StatsDConfig{}
+	case "graphite":
+		args = &GraphiteConfig{}
+	default:
+		return nil, fmt.Errorf("unknown broker type: %s", m.Type)
+	}
+
+	if err := decodeArgs(m, args); err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+type validator interface {
+	Validate() error
+}
+
+func decodeArgs(cfg *Config, args validator) error {
+	if err := transcode(cfg.Args, args); err != nil {
+		return fmt.Errorf("invalid %s broker args: %v", cfg.Type, err)
+	}
+
+	if err := args.Validate(); err != nil {
+		return fmt.Errorf("invalid %s broker args: %v", cfg.Type, err)
+	}
+
+	return nil
+}
+
+func transcode(v, o interface{}) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(b, o)
+}
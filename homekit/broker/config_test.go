@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+func TestNewBroker(t *testing.T) {
+	cfgs := []*Config{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- type: udp
+  args:
+    addr: "[::1]:9090"
+    timestamps:
+      max_skew: 1h
+- type: http
+  args:
+    addr: :8080
+- type: statsd
+  args:
+    addr: :8125
+`), &cfgs))
+
+	log := zap.NewNop().Sugar()
+
+	udp, err := NewBroker(cfgs[0], log)
+	require.NoError(t, err)
+	require.IsType(t, &udpBroker{}, udp)
+	assert.Equal(t, "[::1]:9090", udp.(*udpBroker).cfg.addr())
+	assert.Equal(t, time.Hour, udp.(*udpBroker).cfg.Timestamps.MaxSkew)
+
+	http, err := NewBroker(cfgs[1], log)
+	require.NoError(t, err)
+	assert.IsType(t, &httpBroker{}, http)
+
+	statsd, err := NewBroker(cfgs[2], log)
+	require.NoError(t, err)
+	assert.IsType(t, &statsdBroker{}, statsd)
+}
+
+func TestNewBrokerUnknownType(t *testing.T) {
+	_, err := NewBroker(&Config{Type: "carrier-pigeon"}, zap.NewNop().Sugar())
+	assert.Error(t, err)
+
+	assert.Error(t, (&Config{Type: "carrier-pigeon", Disabled: true}).Validate())
+}
+
+func TestNewBrokerInvalidArgs(t *testing.T) {
+	for _, cfg := range []*Config{
+		{Type: "udp", Args: map[string]interface{}{"port": "nine thousand"}},
+		{Type: "udp", Args: map[string]interface{}{"timestamps": map[string]interface{}{"on_skew": "ignore"}}},
+		{Type: "udp", Args: map[string]interface{}{"format": "xml"}},
+		{Type: "http"},
+		{Type: "mqtt", Args: map[string]interface{}{"addr": "tcp://127.0.0.1:1883"}},
+		{Type: "graphite", Args: map[string]interface{}{"prefix": "/graphite"}},
+	} {
+		_, err := NewBroker(cfg, zap.NewNop().Sugar())
+		assert.Error(t, err, cfg.Type)
+
+		cfg.Disabled = true
+		assert.Error(t, cfg.Validate(), cfg.Type)
+	}
+}
+
+func TestUDPConfigAddr(t *testing.T) {
+	assert.Equal(t, ":9090", (&UDPConfig{Port: 9090}).addr())
+	assert.Equal(t, "127.0.0.1:9091", (&UDPConfig{Addr: "127.0.0.1:9091", Port: 9090}).addr())
+}
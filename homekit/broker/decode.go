@@ -0,0 +1,551 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"homekit-ng/homekit/tm"
+)
+
+// Format is the format of telemetry payloads.
+type Format string
+
+const (
+	// FormatAuto detects the format by the first byte of the payload, see
+	// NewDecoder.
+	FormatAuto Format = "auto"
+	// FormatText is the "<topic>=<value>;..." format, see textDecoder.
+	FormatText Format = "text"
+	// FormatJSON is either an object mapping topics to values, like
+	// {"/home/temp":21.5}, or an array of {topic,value,ts,labels} objects.
+	FormatJSON Format = "json"
+	// FormatNDJSON is newline-delimited {topic,value,ts,labels} objects.
+	FormatNDJSON Format = "ndjson"
+	// FormatCBOR is the compact binary format, see cborDecoder.
+	FormatCBOR Format = "cbor"
+)
+
+// Decoder decodes payloads received at the given time into telemetry
+// values.
+//
+// Errors of individual values are collected, so that valid values are
+// still accepted. The returned error means that the payload is malformed
+// as a whole.
+type Decoder interface {
+	Decode(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error)
+}
+
+// NewDecoder returns the decoder of the given format, resolving
+// sensor-side timestamps according to the TimestampConfig. Topic ids map
+// integer ids of the CBOR format to topics with optional labels.
+//
+// The auto-detected format is CBOR for payloads starting with a CBOR map
+// header, JSON for payloads starting with "[" or "{", except several
+// objects or a single object with the "topic" member, which are NDJSON, and
+// text otherwise.
+func NewDecoder(format Format, timestamps *TimestampConfig, topicIDs map[uint64]string) (Decoder, error) {
+	switch format {
+	case FormatAuto, "":
+		cbor, err := newCBORDecoder(timestamps, topicIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		return &autoDecoder{
+			text:   newTextDecoder(timestamps),
+			json:   &jsonDecoder{timestamps: timestamps},
+			ndjson: &ndjsonDecoder{timestamps: timestamps},
+			cbor:   cbor,
+		}, nil
+	case FormatText:
+		return newTextDecoder(timestamps), nil
+	case FormatJSON:
+		return &jsonDecoder{timestamps: timestamps}, nil
+	case FormatNDJSON:
+		return &ndjsonDecoder{timestamps: timestamps}, nil
+	case FormatCBOR:
+		return newCBORDecoder(timestamps, topicIDs)
+	default:
+		return nil, fmt.Errorf("unknown payload format: %s", format)
+	}
+}
+
+// PairError describes a telemetry value rejected by the decoder.
+type PairError struct {
+	// Index is the zero-based position of the value within the payload,
+	// i.e. of the text pair, the JSON array item or object member, or the
+	// line.
+	Index int
+	// Raw is the text of the value.
+	Raw string
+	Err error
+}
+
+func (m *PairError) Error() string {
+	return fmt.Sprintf("pair %d %q: %v", m.Index, m.Raw, m.Err)
+}
+
+// textDecoder decodes the text format into telemetry values.
+//
+// The format is: "<topic>[{<label>=<value>,...}]=<value>";
+//
+// Labels are optional, i.e. both "temp=21.5" and "temp{room=kitchen}=21.5"
+// are valid.
+//
+// The topic ends at the first "=" or "{", so these characters, as well as
+// ";", quotes and braces, must be escaped with a backslash, like
+// "/home/a\=b=1", or the whole topic must be a double-quoted Go string,
+// like "\"/home/a=b\"=1". The value is everything after the topic, so it
+// may contain "=", while ";" is allowed only within quoted strings.
+//
+// The value may be followed by the sensor-side Unix timestamp in seconds,
+// like "temp=21.5@1560000000", which is accepted according to the
+// TimestampConfig. Otherwise the receive time is used.
+//
+// Values are typed, see tm.ParseTelemetryValue, i.e. "door=true",
+// "counter=42i", "firmware=\"v1.2\"" and "temp=21.5" are all valid.
+type textDecoder struct {
+	timestamps *TimestampConfig
+}
+
+func newTextDecoder(timestamps *TimestampConfig) *textDecoder {
+	return &textDecoder{
+		timestamps: timestamps,
+	}
+}
+
+func (m *textDecoder) Decode(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error) {
+	var tmVec []*tm.Telemetry
+	var errs []*PairError
+	for id, kv := range splitPairs(string(payload)) {
+		kv = strings.TrimSpace(kv)
+
+		if len(kv) == 0 {
+			continue
+		}
+
+		telemetry, err := m.decodePair(kv, now)
+		if err != nil {
+			errs = append(errs, &PairError{Index: id, Raw: kv, Err: err})
+			continue
+		}
+
+		tmVec = append(tmVec, telemetry)
+	}
+
+	return tmVec, errs, nil
+}
+
+func (m *textDecoder) decodePair(kv string, now time.Time) (*tm.Telemetry, error) {
+	topic, rest, err := splitTopic(kv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid telemetry topic: %v", err)
+	}
+	if len(topic) == 0 {
+		return nil, fmt.Errorf("empty telemetry topic")
+	}
+	if tm.IsWildcard(topic) {
+		return nil, fmt.Errorf("wildcards are not allowed in topic %s", topic)
+	}
+
+	var labels tm.Labels
+	if strings.HasPrefix(rest, "{") {
+		close := strings.IndexByte(rest, '}')
+		if close < 0 {
+			return nil, fmt.Errorf("labels of %s must be terminated with '}'", topic)
+		}
+
+		labels, err = tm.ParseLabels(rest[1:close])
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels of %s: %v", topic, err)
+		}
+		rest = rest[close+1:]
+	}
+
+	if !strings.HasPrefix(rest, "=") {
+		return nil, fmt.Errorf("missing value of %s", topic)
+	}
+
+	v, sensorTimestamp, hasTimestamp, err := splitTimestamp(strings.TrimSpace(rest[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid telemetry timestamp: %v", err)
+	}
+
+	value, err := tm.ParseTelemetryValue(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid telemetry value: %v", err)
+	}
+
+	timestamp := now
+	if hasTimestamp {
+		timestamp, err = m.timestamps.resolve(sensorTimestamp, now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid telemetry timestamp of %s: %v", topic, err)
+		}
+	}
+
+	telemetry := &tm.Telemetry{
+		Topic:     topic,
+		Value:     value,
+		Labels:    labels,
+		Timestamp: timestamp,
+	}
+
+	return telemetry, nil
+}
+
+// splitPairs splits the payload on ";" characters, except quoted or escaped
+// ones.
+func splitPairs(v string) []string {
+	var pairs []string
+
+	quoted := false
+	start := 0
+	for id := 0; id < len(v); id++ {
+		switch v[id] {
+		case '\\':
+			id++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				pairs = append(pairs, v[start:id])
+				start = id + 1
+			}
+		}
+	}
+
+	return append(pairs, v[start:])
+}
+
+// splitTopic splits the either quoted or escaped topic off the pair,
+// returning the unescaped topic and the rest of the pair, starting with
+// labels or "=".
+func splitTopic(kv string) (string, string, error) {
+	if strings.HasPrefix(kv, `"`) {
+		end := closingQuote(kv)
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quoted topic")
+		}
+
+		topic, err := strconv.Unquote(kv[:end+1])
+		if err != nil {
+			return "", "", err
+		}
+
+		return topic, kv[end+1:], nil
+	}
+
+	var topic strings.Builder
+	for id := 0; id < len(kv); id++ {
+		switch c := kv[id]; c {
+		case '\\':
+			if id+1 == len(kv) {
+				return "", "", fmt.Errorf("trailing backslash")
+			}
+			id++
+			topic.WriteByte(kv[id])
+		case '=', '{':
+			return topic.String(), kv[id:], nil
+		case '"', '}', ';':
+			return "", "", fmt.Errorf("unexpected %q, it must be escaped", c)
+		default:
+			topic.WriteByte(c)
+		}
+	}
+
+	return topic.String(), "", nil
+}
+
+// closingQuote returns the index of the quote closing the string the value
+// starts with, or -1.
+func closingQuote(v string) int {
+	for id := 1; id < len(v); id++ {
+		switch v[id] {
+		case '\\':
+			id++
+		case '"':
+			return id
+		}
+	}
+
+	return -1
+}
+
+// splitTimestamp splits the optional "@<unix-seconds>" suffix off the
+// value. The "@" character followed by anything except digits is treated as
+// a part of the value, for example within a quoted string.
+func splitTimestamp(v string) (string, time.Time, bool, error) {
+	at := strings.LastIndexByte(v, '@')
+	if at < 0 || strings.ContainsAny(v[at+1:], `"`) {
+		return v, time.Time{}, false, nil
+	}
+
+	seconds, err := strconv.ParseInt(v[at+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+
+	return v[:at], time.Unix(seconds, 0), true, nil
+}
+
+type autoDecoder struct {
+	text   Decoder
+	json   Decoder
+	ndjson Decoder
+	cbor   Decoder
+}
+
+func (m *autoDecoder) Decode(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error) {
+	return m.detect(payload).Decode(payload, now)
+}
+
+func (m *autoDecoder) detect(payload []byte) Decoder {
+	if isCBOR(payload) {
+		return m.cbor
+	}
+
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return m.text
+	}
+
+	switch trimmed[0] {
+	case '[':
+		return m.json
+	case '{':
+		if isNDJSON(trimmed) {
+			return m.ndjson
+		}
+		return m.json
+	default:
+		return m.text
+	}
+}
+
+// isNDJSON checks whether the payload consists of several objects or a
+// single {topic,value,ts,labels} object.
+func isNDJSON(payload []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+
+	var first map[string]json.RawMessage
+	if err := dec.Decode(&first); err != nil {
+		return false
+	}
+
+	if dec.More() {
+		return true
+	}
+
+	_, ok := first["topic"]
+	return ok
+}
+
+type jsonDecoder struct {
+	timestamps *TimestampConfig
+}
+
+func (m *jsonDecoder) Decode(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		return m.decodeArray(trimmed, now)
+	}
+
+	return m.decodeObject(trimmed, now)
+}
+
+func (m *jsonDecoder) decodeArray(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(payload, &items); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	var tmVec []*tm.Telemetry
+	var errs []*PairError
+	for id, raw := range items {
+		telemetry, err := decodeJSONItem(raw, m.timestamps, now)
+		if err != nil {
+			errs = append(errs, &PairError{Index: id, Raw: string(raw), Err: err})
+			continue
+		}
+
+		tmVec = append(tmVec, telemetry)
+	}
+
+	return tmVec, errs, nil
+}
+
+// decodeObject decodes the object mapping topics with optional labels to
+// values, keeping the order of members for error reporting.
+func (m *jsonDecoder) decodeObject(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+
+	token, err := dec.Token()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if token != json.Delim('{') {
+		return nil, nil, fmt.Errorf("expected JSON object or array")
+	}
+
+	var tmVec []*tm.Telemetry
+	var errs []*PairError
+	for id := 0; dec.More(); id++ {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		key := token.(string)
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+
+		telemetry, err := m.decodeMember(key, value, now)
+		if err != nil {
+			errs = append(errs, &PairError{Index: id, Raw: strconv.Quote(key) + ":" + string(value), Err: err})
+			continue
+		}
+
+		tmVec = append(tmVec, telemetry)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if dec.More() {
+		return nil, nil, fmt.Errorf("unexpected data after JSON object")
+	}
+
+	return tmVec, errs, nil
+}
+
+func (m *jsonDecoder) decodeMember(key string, value json.RawMessage, now time.Time) (*tm.Telemetry, error) {
+	topic, labels, err := tm.ParseSeries(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid telemetry topic: %v", err)
+	}
+
+	item := &jsonItem{
+		Topic:  topic,
+		Value:  value,
+		Labels: labels,
+	}
+
+	return item.Telemetry(m.timestamps, now)
+}
+
+type ndjsonDecoder struct {
+	timestamps *TimestampConfig
+}
+
+func (m *ndjsonDecoder) Decode(payload []byte, now time.Time) ([]*tm.Telemetry, []*PairError, error) {
+	var tmVec []*tm.Telemetry
+	var errs []*PairError
+	for id, line := range bytes.Split(payload, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+
+		if len(line) == 0 {
+			continue
+		}
+
+		telemetry, err := decodeJSONItem(line, m.timestamps, now)
+		if err != nil {
+			errs = append(errs, &PairError{Index: id, Raw: string(line), Err: err})
+			continue
+		}
+
+		tmVec = append(tmVec, telemetry)
+	}
+
+	return tmVec, errs, nil
+}
+
+func decodeJSONItem(raw []byte, timestamps *TimestampConfig, now time.Time) (*tm.Telemetry, error) {
+	item := &jsonItem{}
+	if err := json.Unmarshal(raw, item); err != nil {
+		return nil, fmt.Errorf("invalid JSON item: %v", err)
+	}
+
+	return item.Telemetry(timestamps, now)
+}
+
+// jsonItem is the {topic,value,timestamp,labels} object.
+type jsonItem struct {
+	Topic string          `json:"topic"`
+	Value json.RawMessage `json:"value"`
+	// Timestamp is either an RFC 3339 string or Unix seconds, optional.
+	Timestamp json.RawMessage `json:"timestamp"`
+	// TS is the short alias of Timestamp.
+	TS     json.RawMessage `json:"ts"`
+	Labels tm.Labels       `json:"labels"`
+}
+
+func (m *jsonItem) Telemetry(timestamps *TimestampConfig, now time.Time) (*tm.Telemetry, error) {
+	if len(m.Topic) == 0 {
+		return nil, fmt.Errorf("missing topic")
+	}
+	if tm.IsWildcard(m.Topic) {
+		return nil, fmt.Errorf("wildcards are not allowed in topic %s", m.Topic)
+	}
+
+	if len(m.Value) == 0 {
+		return nil, fmt.Errorf("missing value of %s", m.Topic)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(m.Value, &v); err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", m.Topic, err)
+	}
+
+	value, err := jsonValue(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", m.Topic, err)
+	}
+
+	raw := m.Timestamp
+	if len(raw) == 0 {
+		raw = m.TS
+	}
+
+	timestamp := now
+	if len(raw) != 0 && string(raw) != "null" {
+		sensorTimestamp, err := parseJSONTimestamp(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of %s: %v", m.Topic, err)
+		}
+
+		timestamp, err = timestamps.resolve(sensorTimestamp, now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of %s: %v", m.Topic, err)
+		}
+	}
+
+	telemetry := &tm.Telemetry{
+		Topic:     m.Topic,
+		Value:     value,
+		Labels:    m.Labels,
+		Timestamp: timestamp,
+	}
+
+	return telemetry, nil
+}
+
+func parseJSONTimestamp(v json.RawMessage) (time.Time, error) {
+	var seconds int64
+	if err := json.Unmarshal(v, &seconds); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	var timestamp time.Time
+	if err := json.Unmarshal(v, &timestamp); err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 string or Unix seconds")
+	}
+
+	return timestamp, nil
+}
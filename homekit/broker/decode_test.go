@@ -0,0 +1,355 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      string
+		values []*tm.Telemetry
+		errs   []int
+	}{
+		{
+			name: "typed values",
+			v:    `/home/temp=21.5;/home/counter=42i;/home/door=true;/home/firmware="v1.2"`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+				{Topic: "/home/counter", Value: tm.Int(42)},
+				{Topic: "/home/door", Value: tm.Bool(true)},
+				{Topic: "/home/firmware", Value: tm.String("v1.2")},
+			},
+		},
+		{
+			name: "labels",
+			v:    "/home/temp{room=kitchen,sensor=a1}=21.5;/home/temp=20",
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5), Labels: tm.Labels{"room": "kitchen", "sensor": "a1"}},
+				{Topic: "/home/temp", Value: tm.Float(20)},
+			},
+		},
+		{
+			name: "empty pairs and spaces",
+			v:    " /home/temp=21.5 ;; /home/hum= 40;",
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+				{Topic: "/home/hum", Value: tm.Float(40)},
+			},
+		},
+		{
+			name: "values with separators",
+			v:    `/home/mode="heat;cool";/home/expr="a=b";/home/email="me@home"`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/mode", Value: tm.String("heat;cool")},
+				{Topic: "/home/expr", Value: tm.String("a=b")},
+				{Topic: "/home/email", Value: tm.String("me@home")},
+			},
+		},
+		{
+			name: "escaped topics",
+			v:    `/home/a\=b=1;/home/c\;d=2;/home/e\{f\}=3;/home/g\\h=4;/home/\"i\"=5`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/a=b", Value: tm.Float(1)},
+				{Topic: "/home/c;d", Value: tm.Float(2)},
+				{Topic: "/home/e{f}", Value: tm.Float(3)},
+				{Topic: `/home/g\h`, Value: tm.Float(4)},
+				{Topic: `/home/"i"`, Value: tm.Float(5)},
+			},
+		},
+		{
+			name: "quoted topics",
+			v:    `"/home/a=b"=1;"/home/c;d"{room=hall}=2;"/home/\"e\""=3`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/a=b", Value: tm.Float(1)},
+				{Topic: "/home/c;d", Value: tm.Float(2), Labels: tm.Labels{"room": "hall"}},
+				{Topic: `/home/"e"`, Value: tm.Float(3)},
+			},
+		},
+		{
+			name:   "invalid value",
+			v:      "/home/temp=hot",
+			values: nil,
+			errs:   []int{0},
+		},
+		{
+			name: "partial accept",
+			v:    "/home/temp=21.5;/home/bad=hot;/home/counter=42i;/home/nothing",
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+				{Topic: "/home/counter", Value: tm.Int(42)},
+			},
+			errs: []int{1, 3},
+		},
+		{
+			name: "non-finite values",
+			v:    "/home/a=NaN;/home/b=Inf;/home/c=-Inf;/home/d=21.5",
+			values: []*tm.Telemetry{
+				{Topic: "/home/d", Value: tm.Float(21.5)},
+			},
+			errs: []int{0, 1, 2},
+		},
+		{
+			name:   "invalid labels",
+			v:      "/home/temp{room=kitchen=21.5;/home/temp{room}=21.5;{room=kitchen}=21.5",
+			values: nil,
+			errs:   []int{0, 1, 2},
+		},
+		{
+			name:   "invalid topics",
+			v:      `/home/a"b"=1;/home/c}=2;=3;/home/d\`,
+			values: nil,
+			errs:   []int{0, 1, 2, 3},
+		},
+		{
+			name: "wildcard topics",
+			v:    `/home/+/x=1;/home/#=2;/home/temp=3;"/home/+"{room=kitchen}=4`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(3)},
+			},
+			errs: []int{0, 1, 3},
+		},
+		{
+			// The unterminated quote swallows the rest of the packet.
+			name: "unterminated quoted topic",
+			v:    `/home/a=1;"/home/b=2;/home/c=3`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/a", Value: tm.Float(1)},
+			},
+			errs: []int{1},
+		},
+	}
+
+	now := time.Unix(1560000000, 0)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := newTextDecoder(nil)
+
+			for _, telemetry := range test.values {
+				telemetry.Timestamp = now
+			}
+
+			values, errs, err := decoder.Decode([]byte(test.v), now)
+			require.NoError(t, err)
+			assert.Equal(t, test.values, values)
+
+			var indices []int
+			for _, err := range errs {
+				assert.Error(t, err.Err)
+				indices = append(indices, err.Index)
+			}
+			assert.Equal(t, test.errs, indices)
+		})
+	}
+}
+
+func TestPairError(t *testing.T) {
+	decoder := newTextDecoder(nil)
+
+	_, errs, err := decoder.Decode([]byte("/home/temp=21.5; /home/bad=hot "), time.Now())
+	require.NoError(t, err)
+	require.Len(t, errs, 1)
+
+	assert.Equal(t, 1, errs[0].Index)
+	assert.Equal(t, "/home/bad=hot", errs[0].Raw)
+	assert.Contains(t, errs[0].Error(), `pair 1 "/home/bad=hot": invalid telemetry value`)
+}
+
+func TestDecodeTimestampIgnoredByDefault(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	decoder := newTextDecoder(&TimestampConfig{})
+
+	telemetries, errs, err := decoder.Decode([]byte("/home/temp=21.5@1559990000"), now)
+	require.NoError(t, err)
+	require.Empty(t, errs)
+	require.Len(t, telemetries, 1)
+
+	assert.Equal(t, tm.Float(21.5), telemetries[0].Value)
+	assert.Equal(t, now, telemetries[0].Timestamp)
+}
+
+func TestDecodeTimestamp(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+
+	tests := []struct {
+		policy    SkewPolicy
+		v         string
+		timestamp time.Time
+		fail      bool
+	}{
+		{SkewFallback, "/home/temp=21.5", now, false},
+		{SkewFallback, "/home/temp=21.5@1559999000", time.Unix(1559999000, 0), false},
+		{SkewFallback, "/home/temp=21.5@1560007200", now, false},
+		{SkewFallback, "/home/temp=21.5@1550000000", now, false},
+		{SkewReject, "/home/temp=21.5@1559999000", time.Unix(1559999000, 0), false},
+		{SkewReject, "/home/temp=21.5@1550000000", time.Time{}, true},
+		{SkewReject, "/home/temp=21.5@yesterday", time.Time{}, true},
+		{SkewReject, `/home/email="me@home"`, now, false},
+	}
+
+	for _, test := range tests {
+		decoder := newTextDecoder(&TimestampConfig{MaxSkew: time.Hour, OnSkew: test.policy})
+
+		telemetries, errs, err := decoder.Decode([]byte(test.v), now)
+		require.NoError(t, err, test.v)
+		if test.fail {
+			assert.Len(t, errs, 1, test.v)
+			assert.Empty(t, telemetries, test.v)
+			continue
+		}
+
+		require.Empty(t, errs, test.v)
+		require.Len(t, telemetries, 1, test.v)
+		assert.Equal(t, test.timestamp, telemetries[0].Timestamp, test.v)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+
+	tests := []struct {
+		name   string
+		format Format
+		v      string
+		values []*tm.Telemetry
+		errs   []int
+	}{
+		{
+			name:   "object",
+			format: FormatJSON,
+			v:      `{"/home/temp": 21.5, "/home/door": true, "/home/hum{room=hall}": 40, "/home/mode": "heat"}`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+				{Topic: "/home/door", Value: tm.Bool(true)},
+				{Topic: "/home/hum", Value: tm.Float(40), Labels: tm.Labels{"room": "hall"}},
+				{Topic: "/home/mode", Value: tm.String("heat")},
+			},
+		},
+		{
+			name:   "object with invalid members",
+			format: FormatJSON,
+			v:      `{"/home/temp": 21.5, "/home/bad": {"a": 1}, "/home/+": 1, "/home/hum": 40}`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+				{Topic: "/home/hum", Value: tm.Float(40)},
+			},
+			errs: []int{1, 2},
+		},
+		{
+			name:   "array",
+			format: FormatJSON,
+			v:      `[{"topic": "/home/temp", "value": 21.5, "ts": 1559999000, "labels": {"room": "kitchen"}}, {"topic": "/home/door", "value": false}]`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5), Labels: tm.Labels{"room": "kitchen"}, Timestamp: time.Unix(1559999000, 0)},
+				{Topic: "/home/door", Value: tm.Bool(false)},
+			},
+		},
+		{
+			name:   "array with invalid items",
+			format: FormatJSON,
+			v:      `[{"topic": "/home/temp", "value": 21.5}, {"value": 1}, 42, {"topic": "/home/hum", "value": [1]}]`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+			},
+			errs: []int{1, 2, 3},
+		},
+		{
+			name:   "ndjson",
+			format: FormatNDJSON,
+			v:      "{\"topic\": \"/home/temp\", \"value\": 21.5}\n\n{\"topic\": \"/home/bad\"\n{\"topic\": \"/home/door\", \"value\": true, \"timestamp\": \"2019-06-08T13:06:40Z\"}\n",
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+				{Topic: "/home/door", Value: tm.Bool(true), Timestamp: time.Unix(1559999200, 0).UTC()},
+			},
+			errs: []int{2},
+		},
+		{
+			name:   "auto text",
+			format: FormatAuto,
+			v:      "/home/temp=21.5",
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+			},
+		},
+		{
+			name:   "auto object",
+			format: FormatAuto,
+			v:      ` {"/home/temp": 21.5}`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+			},
+		},
+		{
+			name:   "auto array",
+			format: FormatAuto,
+			v:      `[{"topic": "/home/temp", "value": 21.5}]`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+			},
+		},
+		{
+			name:   "auto single item",
+			format: FormatAuto,
+			v:      `{"topic": "/home/temp", "value": 21.5}`,
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+			},
+		},
+		{
+			name:   "auto ndjson",
+			format: FormatAuto,
+			v:      "{\"topic\": \"/home/temp\", \"value\": 21.5}\n{\"topic\": \"/home/hum\", \"value\": 40}",
+			values: []*tm.Telemetry{
+				{Topic: "/home/temp", Value: tm.Float(21.5)},
+				{Topic: "/home/hum", Value: tm.Float(40)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder, err := NewDecoder(test.format, &TimestampConfig{MaxSkew: time.Hour}, nil)
+			require.NoError(t, err)
+
+			for _, telemetry := range test.values {
+				if telemetry.Timestamp.IsZero() {
+					telemetry.Timestamp = now
+				}
+			}
+
+			values, errs, err := decoder.Decode([]byte(test.v), now)
+			require.NoError(t, err)
+			assert.Equal(t, test.values, values)
+
+			var indices []int
+			for _, err := range errs {
+				assert.Error(t, err.Err)
+				indices = append(indices, err.Index)
+			}
+			assert.Equal(t, test.errs, indices)
+		})
+	}
+}
+
+func TestDecodeMalformedJSON(t *testing.T) {
+	for _, v := range []string{`{"/home/temp": 21.5`, `[{"topic": "/home/temp"}`, `{"/home/temp": 21.5} 42`, `"/home/temp"`} {
+		decoder, err := NewDecoder(FormatJSON, nil, nil)
+		require.NoError(t, err)
+
+		values, _, err := decoder.Decode([]byte(v), time.Now())
+		assert.Error(t, err, v)
+		assert.Nil(t, values, v)
+	}
+}
+
+func TestNewDecoderUnknownFormat(t *testing.T) {
+	_, err := NewDecoder("xml", nil, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,349 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	DefaultGraphiteIdleTimeout = 5 * time.Minute
+
+	graphiteMaxLineSize = 64 * 1024
+)
+
+// GraphiteConfig describes the Graphite plaintext protocol listener.
+type GraphiteConfig struct {
+	// TCPAddr is the TCP listen address, like ":2003", optional.
+	TCPAddr string `yaml:"tcp_addr"`
+	// UDPAddr is the UDP listen address, like ":2003", optional.
+	UDPAddr string `yaml:"udp_addr"`
+	// Prefix is prepended to topics, i.e. "home.kitchen.temp" with
+	// "/graphite" prefix becomes "/graphite/home/kitchen/temp".
+	Prefix     string
+	Timestamps TimestampConfig
+	// IdleTimeout closes TCP connections without lines for this long.
+	//
+	// Defaults to 5m.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+func (m *GraphiteConfig) Validate() error {
+	if len(m.TCPAddr) == 0 && len(m.UDPAddr) == 0 {
+		return fmt.Errorf("either TCP or UDP address is required for Graphite listener")
+	}
+
+	if m.IdleTimeout < 0 {
+		return fmt.Errorf("negative Graphite idle timeout: %s", m.IdleTimeout)
+	}
+
+	return m.Timestamps.Validate()
+}
+
+func (m *GraphiteConfig) idleTimeout() time.Duration {
+	if m.IdleTimeout == 0 {
+		return DefaultGraphiteIdleTimeout
+	}
+
+	return m.IdleTimeout
+}
+
+// dottedTopic maps the dotted metric path, like "home.kitchen.temp", to the
+// slash-separated topic, like "/home/kitchen/temp".
+func dottedTopic(prefix, path string) (string, error) {
+	if len(path) == 0 {
+		return "", fmt.Errorf("empty metric path")
+	}
+
+	topic := strings.TrimSuffix(prefix, tm.TopicSeparator) + tm.TopicSeparator +
+		strings.Replace(path, ".", tm.TopicSeparator, -1)
+	if tm.IsWildcard(topic) {
+		return "", fmt.Errorf("wildcards are not allowed in topic %s", topic)
+	}
+
+	return topic, nil
+}
+
+// graphiteDecoder decodes Graphite plaintext lines, i.e.
+// "<path>[;<tag>=<value>...] <value> [<timestamp>]", into telemetry values.
+//
+// Tags are mapped to labels. The timestamp is in Unix seconds, missing or
+// "-1" timestamp means the receive time.
+type graphiteDecoder struct {
+	Prefix     string
+	Timestamps *TimestampConfig
+	// Now returns the receive time, overridden in tests.
+	Now func() time.Time
+}
+
+func newGraphiteDecoder(cfg *GraphiteConfig) *graphiteDecoder {
+	return &graphiteDecoder{
+		Prefix:     cfg.Prefix,
+		Timestamps: &cfg.Timestamps,
+		Now:        time.Now,
+	}
+}
+
+func (m *graphiteDecoder) Decode(line string) (*tm.Telemetry, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("expected \"<path> <value> [<timestamp>]\", got %q", line)
+	}
+
+	path, labels, err := parseGraphiteTags(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := dottedTopic(m.Prefix, path)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", topic, err)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("non-finite value of %s: %s", topic, fields[1])
+	}
+
+	now := m.Now()
+	timestamp := now
+	if len(fields) == 3 && fields[2] != "-1" {
+		seconds, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of %s: %v", topic, err)
+		}
+
+		integer, fraction := math.Modf(seconds)
+		timestamp, err = m.Timestamps.resolve(time.Unix(int64(integer), int64(fraction*1e9)), now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of %s: %v", topic, err)
+		}
+	}
+
+	telemetry := &tm.Telemetry{
+		Topic:     topic,
+		Value:     tm.Float(value),
+		Labels:    labels,
+		Timestamp: timestamp,
+	}
+
+	return telemetry, nil
+}
+
+func parseGraphiteTags(v string) (string, tm.Labels, error) {
+	parts := strings.Split(v, ";")
+	if len(parts) == 1 {
+		return v, nil, nil
+	}
+
+	labels := tm.Labels{}
+	for _, pair := range parts[1:] {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return "", nil, fmt.Errorf("invalid tag %q of %s", pair, parts[0])
+		}
+
+		labels[kv[0]] = kv[1]
+	}
+
+	return parts[0], labels, nil
+}
+
+// graphiteBroker accepts Graphite plaintext protocol via TCP and/or UDP,
+// one metric per line.
+type graphiteBroker struct {
+	cfg *GraphiteConfig
+	log *zap.SugaredLogger
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+}
+
+func NewGraphiteBroker(cfg *GraphiteConfig, log *zap.SugaredLogger) *graphiteBroker {
+	return &graphiteBroker{
+		cfg:   cfg,
+		log:   log,
+		conns: map[net.Conn]struct{}{},
+	}
+}
+
+func (m *graphiteBroker) Run(ctx context.Context, storage *tm.TelemetryStorage) error {
+	if err := m.cfg.Validate(); err != nil {
+		return err
+	}
+
+	var sock net.PacketConn
+	if len(m.cfg.UDPAddr) != 0 {
+		var err error
+		sock, err = net.ListenPacket("udp", m.cfg.UDPAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	var listener net.Listener
+	if len(m.cfg.TCPAddr) != 0 {
+		var err error
+		listener, err = net.Listen("tcp", m.cfg.TCPAddr)
+		if err != nil {
+			if sock != nil {
+				sock.Close()
+			}
+			return err
+		}
+	}
+
+	wg, ctx := errgroup.WithContext(ctx)
+
+	if sock != nil {
+		wg.Go(func() error {
+			return m.runUDP(ctx, sock, storage)
+		})
+		wg.Go(func() error {
+			<-ctx.Done()
+			if err := sock.Close(); err != nil {
+				m.log.Warnf("failed to close UDP socket: %v", err)
+			}
+			return ctx.Err()
+		})
+	}
+
+	if listener != nil {
+		wg.Go(func() error {
+			return m.serveTCP(ctx, listener, storage)
+		})
+	}
+
+	return wg.Wait()
+}
+
+// This function MUST never finish with "nil" error.
+func (m *graphiteBroker) runUDP(ctx context.Context, sock net.PacketConn, storage *tm.TelemetryStorage) error {
+	decoder := newGraphiteDecoder(m.cfg)
+
+	buf := make([]byte, graphiteMaxLineSize)
+	for {
+		nRead, remoteAddr, err := sock.ReadFrom(buf[:])
+		if err != nil {
+			return err
+		}
+
+		m.log.Debugf("received %d bytes from %s", nRead, remoteAddr)
+
+		var values []*tm.Telemetry
+		for _, line := range strings.Split(string(buf[:nRead]), "\n") {
+			if len(strings.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			telemetry, err := decoder.Decode(line)
+			if err != nil {
+				m.log.Warnf("failed to parse Graphite line from %s: %v", remoteAddr, err)
+				continue
+			}
+
+			values = append(values, telemetry)
+		}
+
+		if len(values) > 0 {
+			storage.PutMulti(values)
+		}
+	}
+}
+
+func (m *graphiteBroker) serveTCP(ctx context.Context, listener net.Listener, storage *tm.TelemetryStorage) error {
+	m.log.Infof("serving Graphite on %s", listener.Addr())
+
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return err
+			}
+
+			// Connections are registered before serving, so the ones
+			// accepted during shutdown are either closed below or refused.
+			m.mu.Lock()
+			if m.closing {
+				m.mu.Unlock()
+				conn.Close()
+				continue
+			}
+			m.conns[conn] = struct{}{}
+			m.mu.Unlock()
+
+			go m.handle(conn, storage)
+		}
+	})
+
+	<-ctx.Done()
+	if err := listener.Close(); err != nil {
+		m.log.Warnf("failed to close Graphite listener: %v", err)
+	}
+
+	m.mu.Lock()
+	m.closing = true
+	for conn := range m.conns {
+		conn.Close()
+	}
+	m.mu.Unlock()
+
+	return wg.Wait()
+}
+
+func (m *graphiteBroker) handle(conn net.Conn, storage *tm.TelemetryStorage) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, conn)
+		m.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	decoder := newGraphiteDecoder(m.cfg)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), graphiteMaxLineSize)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(m.cfg.idleTimeout())); err != nil {
+			m.log.Debugf("failed to set Graphite read deadline: %v", err)
+			return
+		}
+		if !scanner.Scan() {
+			break
+		}
+
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		telemetry, err := decoder.Decode(line)
+		if err != nil {
+			m.log.Warnf("failed to parse Graphite line from %s: %v", conn.RemoteAddr(), err)
+			continue
+		}
+
+		storage.PutMulti([]*tm.Telemetry{telemetry})
+	}
+
+	if err := scanner.Err(); err != nil {
+		m.log.Debugf("Graphite connection from %s closed: %v", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+func TestGraphiteDecode(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	decoder := newGraphiteDecoder(&GraphiteConfig{Prefix: "/graphite/"})
+	decoder.Now = func() time.Time { return now }
+
+	telemetry, err := decoder.Decode("home.kitchen.temp 21.5 1559990000")
+	require.NoError(t, err)
+	assert.Equal(t, "/graphite/home/kitchen/temp", telemetry.Topic)
+	assert.Equal(t, tm.Float(21.5), telemetry.Value)
+	// Sensor-side timestamps are ignored by default.
+	assert.True(t, now.Equal(telemetry.Timestamp))
+}
+
+func TestGraphiteDecodeTimestamp(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	decoder := newGraphiteDecoder(&GraphiteConfig{Timestamps: TimestampConfig{MaxSkew: 24 * time.Hour}})
+	decoder.Now = func() time.Time { return now }
+
+	telemetry, err := decoder.Decode("temp 21.5 1559990000.5")
+	require.NoError(t, err)
+	assert.True(t, time.Unix(1559990000, 5e8).Equal(telemetry.Timestamp))
+
+	telemetry, err = decoder.Decode("temp 21.5 -1")
+	require.NoError(t, err)
+	assert.True(t, now.Equal(telemetry.Timestamp))
+}
+
+func TestGraphiteDecodeTags(t *testing.T) {
+	decoder := newGraphiteDecoder(&GraphiteConfig{})
+
+	telemetry, err := decoder.Decode("temp;room=kitchen;sensor=a1 21.5")
+	require.NoError(t, err)
+	assert.Equal(t, "/temp", telemetry.Topic)
+	assert.Equal(t, tm.Labels{"room": "kitchen", "sensor": "a1"}, telemetry.Labels)
+}
+
+func TestGraphiteDecodeInvalid(t *testing.T) {
+	decoder := newGraphiteDecoder(&GraphiteConfig{})
+
+	for _, line := range []string{
+		"temp",
+		"temp 21.5 1559990000 extra",
+		"temp hot",
+		"temp 21.5 yesterday",
+		"temp;room 21.5",
+		"home.#.temp 21.5",
+		"temp NaN",
+		"temp +Inf",
+		"temp -inf 1559990000",
+	} {
+		_, err := decoder.Decode(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestGraphiteTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	storage := tm.NewTelemetryStorage()
+	graphite := NewGraphiteBroker(&GraphiteConfig{TCPAddr: listener.Addr().String()}, zap.NewNop().Sugar())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- graphite.serveTCP(ctx, listener, storage)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprint(conn, "home.temp 21.5\ngarbage\nhome.humidity 40\n")
+	require.NoError(t, err)
+
+	assert.Equal(t, tm.Float(21.5), waitTelemetry(t, storage, "/home/temp").Value)
+	assert.Equal(t, tm.Float(40), waitTelemetry(t, storage, "/home/humidity").Value)
+}
+
+func TestGraphiteTCPIdleTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	storage := tm.NewTelemetryStorage()
+	graphite := NewGraphiteBroker(&GraphiteConfig{
+		TCPAddr:     listener.Addr().String(),
+		IdleTimeout: 50 * time.Millisecond,
+	}, zap.NewNop().Sugar())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- graphite.serveTCP(ctx, listener, storage)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
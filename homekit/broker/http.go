@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	httpTelemetryPath = "/api/v1/telemetry"
+	httpMaxBodySize   = 1 << 20
+)
+
+type HTTPConfig struct {
+	// Addr is the listen address, like ":8080".
+	Addr       string
+	Timestamps TimestampConfig
+}
+
+func (m *HTTPConfig) Validate() error {
+	if len(m.Addr) == 0 {
+		return fmt.Errorf("address is required for HTTP listener")
+	}
+
+	return m.Timestamps.Validate()
+}
+
+// httpBroker accepts telemetry via "POST /api/v1/telemetry".
+//
+// The body is either JSON, which is a single {topic,value,timestamp,labels}
+// object or an array of them, or the "<topic>=<value>;..." text format the
+// UDP broker accepts, depending on the Content-Type.
+type httpBroker struct {
+	cfg *HTTPConfig
+	log *zap.SugaredLogger
+}
+
+func NewHTTPBroker(cfg *HTTPConfig, log *zap.SugaredLogger) *httpBroker {
+	return &httpBroker{
+		cfg: cfg,
+		log: log,
+	}
+}
+
+func (m *httpBroker) Run(ctx context.Context, storage *tm.TelemetryStorage) error {
+	if err := m.cfg.Validate(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	return m.serve(ctx, listener, storage)
+}
+
+func (m *httpBroker) serve(ctx context.Context, listener net.Listener, storage *tm.TelemetryStorage) error {
+	server := &http.Server{
+		Handler:      m.handler(storage),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		return server.Serve(listener)
+	})
+
+	<-ctx.Done()
+	if err := server.Close(); err != nil {
+		m.log.Warnf("failed to close HTTP server: %v", err)
+	}
+
+	return wg.Wait()
+}
+
+func (m *httpBroker) handler(storage *tm.TelemetryStorage) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpTelemetryPath, func(wr http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			wr.Header().Set("Allow", http.MethodPost)
+			http.Error(wr, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(wr, req.Body, httpMaxBodySize))
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		telemetries, itemErrors, err := m.decode(req.Header.Get("Content-Type"), body)
+		if err != nil {
+			status := http.StatusBadRequest
+			if _, ok := err.(unsupportedMediaTypeError); ok {
+				status = http.StatusUnsupportedMediaType
+			}
+
+			m.writeResponse(wr, status, &httpResponse{Error: err.Error()})
+			return
+		}
+
+		if len(telemetries) > 0 {
+			storage.PutMulti(telemetries)
+		}
+
+		status := http.StatusOK
+		if len(telemetries) == 0 && len(itemErrors) > 0 {
+			status = http.StatusBadRequest
+		}
+
+		for _, itemError := range itemErrors {
+			m.log.Warnf("rejected telemetry item %d from %s: %s", itemError.Index, req.RemoteAddr, itemError.Error)
+		}
+
+		m.writeResponse(wr, status, &httpResponse{
+			Accepted: len(telemetries),
+			Errors:   itemErrors,
+		})
+	})
+
+	return mux
+}
+
+func (m *httpBroker) writeResponse(wr http.ResponseWriter, status int, response *httpResponse) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+
+	if err := json.NewEncoder(wr).Encode(response); err != nil {
+		m.log.Debugf("failed to write HTTP response: %v", err)
+	}
+}
+
+// decode decodes the body according to its content type, collecting
+// errors of individual items. The returned error means that the body is
+// malformed as a whole.
+func (m *httpBroker) decode(contentType string, body []byte) ([]*tm.Telemetry, []*httpItemError, error) {
+	mediaType := "text/plain"
+	if len(contentType) != 0 {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid content type: %v", err)
+		}
+	}
+
+	switch mediaType {
+	case "application/json":
+		return m.decodeJSON(body)
+	case "text/plain":
+		return m.decodeText(string(body))
+	default:
+		return nil, nil, unsupportedMediaTypeError(mediaType)
+	}
+}
+
+// unsupportedMediaTypeError is returned for bodies of unknown media types.
+type unsupportedMediaTypeError string
+
+func (m unsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("unsupported content type: %s", string(m))
+}
+
+func (m *httpBroker) decodeJSON(body []byte) ([]*tm.Telemetry, []*httpItemError, error) {
+	var items []json.RawMessage
+
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		// Items are decoded one by one, so that malformed ones, like null,
+		// are reported as item errors.
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	} else {
+		var item json.RawMessage
+		if err := json.Unmarshal(body, &item); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	now := time.Now()
+
+	var telemetries []*tm.Telemetry
+	var itemErrors []*httpItemError
+	for id, item := range items {
+		telemetry, err := decodeJSONItem(item, &m.cfg.Timestamps, now)
+		if err != nil {
+			itemErrors = append(itemErrors, &httpItemError{Index: id, Error: err.Error()})
+			continue
+		}
+
+		telemetries = append(telemetries, telemetry)
+	}
+
+	return telemetries, itemErrors, nil
+}
+
+func (m *httpBroker) decodeText(body string) ([]*tm.Telemetry, []*httpItemError, error) {
+	telemetries, pairErrs, err := newTextDecoder(&m.cfg.Timestamps).Decode([]byte(body), time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var itemErrors []*httpItemError
+	for _, err := range pairErrs {
+		itemErrors = append(itemErrors, &httpItemError{Index: err.Index, Error: err.Err.Error()})
+	}
+
+	return telemetries, itemErrors, nil
+}
+
+type httpResponse struct {
+	Accepted int              `json:"accepted"`
+	Errors   []*httpItemError `json:"errors,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+type httpItemError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
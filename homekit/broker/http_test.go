@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+func postTelemetry(t *testing.T, storage *tm.TelemetryStorage, cfg *HTTPConfig, contentType, body string) (int, *httpResponse) {
+	handler := NewHTTPBroker(cfg, zap.NewNop().Sugar()).handler(storage)
+
+	req := httptest.NewRequest(http.MethodPost, httpTelemetryPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, req)
+
+	response := &httpResponse{}
+	require.NoError(t, json.Unmarshal(wr.Body.Bytes(), response))
+
+	return wr.Code, response
+}
+
+func TestHTTPSingleObject(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	code, response := postTelemetry(t, storage, &HTTPConfig{}, "application/json",
+		`{"topic": "/home/temp", "value": 21.5, "labels": {"room": "kitchen"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, response.Accepted)
+	assert.Empty(t, response.Errors)
+
+	telemetries := storage.Read("/home/temp")
+	require.Len(t, telemetries, 1)
+	assert.Equal(t, tm.Float(21.5), telemetries[0].Value)
+	assert.Equal(t, tm.Labels{"room": "kitchen"}, telemetries[0].Labels)
+}
+
+func TestHTTPArrayPartialAccept(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+	cfg := &HTTPConfig{Timestamps: TimestampConfig{MaxSkew: 24 * time.Hour, OnSkew: SkewReject}}
+	timestamp := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	code, response := postTelemetry(t, storage, cfg, "application/json; charset=utf-8", `[
+		{"topic": "/home/temp", "value": 21.5, "timestamp": `+jsonInt(timestamp.Unix())+`},
+		{"topic": "/home/door", "value": true},
+		{"topic": "/home/mode", "value": "heat", "timestamp": "`+timestamp.Format(time.RFC3339)+`"},
+		{"topic": "", "value": 1},
+		{"topic": "/home/+/temp", "value": 1},
+		{"topic": "/home/list", "value": [1, 2]},
+		{"topic": "/home/old", "value": 1, "timestamp": 1000000000},
+		{"topic": "/home/missing"},
+		null,
+		42
+	]`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, response.Accepted)
+
+	var indices []int
+	for _, itemError := range response.Errors {
+		indices = append(indices, itemError.Index)
+	}
+	assert.Equal(t, []int{3, 4, 5, 6, 7, 8, 9}, indices)
+	assert.Equal(t, "missing topic", response.Errors[5].Error)
+
+	assert.True(t, timestamp.Equal(storage.Read("/home/temp")[0].Timestamp))
+	assert.True(t, timestamp.Equal(storage.Read("/home/mode")[0].Timestamp))
+	assert.Equal(t, tm.Bool(true), storage.Read("/home/door")[0].Value)
+}
+
+func TestHTTPText(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	code, response := postTelemetry(t, storage, &HTTPConfig{}, "text/plain", "/home/temp=21.5;/home/bad=hot;/home/counter=42i")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, response.Accepted)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, 1, response.Errors[0].Index)
+
+	assert.Equal(t, tm.Int(42), storage.Read("/home/counter")[0].Value)
+}
+
+func TestHTTPRejected(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	code, response := postTelemetry(t, storage, &HTTPConfig{}, "application/json", `{"topic": "/home/temp"`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.NotEmpty(t, response.Error)
+
+	code, response = postTelemetry(t, storage, &HTTPConfig{}, "application/json", `[{"topic": "/home/temp"}]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Len(t, response.Errors, 1)
+
+	code, _ = postTelemetry(t, storage, &HTTPConfig{}, "application/xml", `<telemetry/>`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, code)
+
+	assert.Empty(t, storage.Read("#"))
+}
+
+func TestHTTPMethodNotAllowed(t *testing.T) {
+	handler := NewHTTPBroker(&HTTPConfig{}, zap.NewNop().Sugar()).handler(tm.NewTelemetryStorage())
+
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, httptest.NewRequest(http.MethodGet, httpTelemetryPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, wr.Code)
+}
+
+func jsonInt(v int64) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,318 @@
+package broker
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	defaultBanWindow = time.Minute
+
+	// Sources that have not sent anything for this long are forgotten,
+	// including the topics they have written.
+	sourceIdleTimeout      = 10 * time.Minute
+	limiterCleanupInterval = time.Minute
+)
+
+// UDPLimitsConfig protects the storage from flooding sources.
+//
+// Every limit is disabled when zero.
+type UDPLimitsConfig struct {
+	// SourceRate is the number of datagrams per second allowed from each
+	// source address, with SourceBurst datagrams allowed at once.
+	//
+	// The burst defaults to the rate, rounded up.
+	SourceRate  float64 `yaml:"source_rate"`
+	SourceBurst int     `yaml:"source_burst"`
+	// GlobalRate and GlobalBurst limit datagrams from all sources together.
+	GlobalRate  float64 `yaml:"global_rate"`
+	GlobalBurst int     `yaml:"global_burst"`
+	// MaxPairs is the maximum number of telemetry pairs per datagram.
+	// Larger datagrams are rejected as a whole.
+	MaxPairs int `yaml:"max_pairs"`
+	// MaxTopics is the maximum number of distinct topics each source is
+	// allowed to write. Telemetry of new topics over the limit is rejected.
+	MaxTopics int `yaml:"max_topics"`
+	// BanThreshold is the number of violations of the limits above within
+	// BanWindow, after which the source is banned for BanDuration.
+	//
+	// The window defaults to 1m.
+	BanThreshold int           `yaml:"ban_threshold"`
+	BanWindow    time.Duration `yaml:"ban_window"`
+	BanDuration  time.Duration `yaml:"ban_duration"`
+}
+
+func (m *UDPLimitsConfig) Validate() error {
+	if m.SourceRate < 0 || m.GlobalRate < 0 {
+		return fmt.Errorf("negative UDP rate limit")
+	}
+
+	if m.SourceBurst < 0 || m.GlobalBurst < 0 {
+		return fmt.Errorf("negative UDP burst limit")
+	}
+
+	if m.MaxPairs < 0 || m.MaxTopics < 0 {
+		return fmt.Errorf("negative UDP pairs or topics limit")
+	}
+
+	if m.BanThreshold < 0 || m.BanWindow < 0 || m.BanDuration < 0 {
+		return fmt.Errorf("negative UDP ban settings")
+	}
+
+	if m.BanThreshold > 0 && m.BanDuration == 0 {
+		return fmt.Errorf("UDP ban threshold requires ban duration")
+	}
+
+	return nil
+}
+
+func (m *UDPLimitsConfig) banWindow() time.Duration {
+	if m.BanWindow == 0 {
+		return defaultBanWindow
+	}
+
+	return m.BanWindow
+}
+
+func (m *UDPLimitsConfig) bansEnabled() bool {
+	return m.BanThreshold > 0 && m.BanDuration > 0
+}
+
+func (m *UDPLimitsConfig) tracksSources() bool {
+	return m.SourceRate > 0 || m.MaxTopics > 0 || m.bansEnabled()
+}
+
+// tokenBucket allows events at the given rate with bursts.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (m *tokenBucket) Allow(now time.Time) bool {
+	if elapsed := now.Sub(m.last).Seconds(); elapsed > 0 {
+		m.tokens = math.Min(m.burst, m.tokens+elapsed*m.rate)
+		m.last = now
+	}
+
+	if m.tokens < 1 {
+		return false
+	}
+
+	m.tokens--
+	return true
+}
+
+type sourceState struct {
+	bucket          *tokenBucket
+	topics          map[string]struct{}
+	violations      int
+	violationsSince time.Time
+	bannedUntil     time.Time
+	lastSeen        time.Time
+}
+
+type limiterMetrics struct {
+	sourceRateLimited *metrics.Counter
+	globalRateLimited *metrics.Counter
+	tooManyPairs      *metrics.Counter
+	tooManyTopics     *metrics.Counter
+	banned            *metrics.Counter
+	bans              *metrics.Counter
+}
+
+// limiter applies UDPLimitsConfig to datagrams, logging and counting
+// everything it rejects.
+//
+// It is not safe for concurrent use.
+type limiter struct {
+	cfg         *UDPLimitsConfig
+	global      *tokenBucket
+	sources     map[string]*sourceState
+	lastCleanup time.Time
+	metrics     *limiterMetrics
+	log         *zap.SugaredLogger
+}
+
+// newLimiter constructs the limiter, registering its counters labeled with
+// the broker address in the registry. Since only one socket can be bound to
+// the address, the counters are shared only by limiters of the same broker
+// across restarts, which keeps them monotonic.
+func newLimiter(cfg *UDPLimitsConfig, registry *metrics.Registry, addr string, log *zap.SugaredLogger) *limiter {
+	labels := tm.Labels{"addr": addr}
+
+	limiter := &limiter{
+		cfg:     cfg,
+		sources: map[string]*sourceState{},
+		metrics: &limiterMetrics{
+			sourceRateLimited: registry.Counter("udp/source_rate_limited", labels),
+			globalRateLimited: registry.Counter("udp/global_rate_limited", labels),
+			tooManyPairs:      registry.Counter("udp/too_many_pairs", labels),
+			tooManyTopics:     registry.Counter("udp/too_many_topics", labels),
+			banned:            registry.Counter("udp/banned", labels),
+			bans:              registry.Counter("udp/bans", labels),
+		},
+		log: log,
+	}
+
+	if cfg.GlobalRate > 0 {
+		limiter.global = newTokenBucket(cfg.GlobalRate, cfg.GlobalBurst, time.Now())
+	}
+
+	return limiter
+}
+
+// AllowDatagram checks whether a datagram from the given source address is
+// allowed by ban and rate limits.
+func (m *limiter) AllowDatagram(source string, now time.Time) bool {
+	m.cleanup(now)
+
+	state := m.source(source, now)
+	if state != nil {
+		if now.Before(state.bannedUntil) {
+			m.metrics.banned.Inc()
+			return false
+		}
+
+		if state.bucket != nil && !state.bucket.Allow(now) {
+			m.log.Debugf("rate limited datagram from %s", source)
+			m.metrics.sourceRateLimited.Inc()
+			m.violate(source, state, now)
+			return false
+		}
+	}
+
+	if m.global != nil && !m.global.Allow(now) {
+		m.log.Debugf("globally rate limited datagram from %s", source)
+		m.metrics.globalRateLimited.Inc()
+		return false
+	}
+
+	return true
+}
+
+// AllowPairs checks the number of pairs in a datagram.
+func (m *limiter) AllowPairs(source string, pairs int, now time.Time) bool {
+	if m.cfg.MaxPairs == 0 || pairs <= m.cfg.MaxPairs {
+		return true
+	}
+
+	m.log.Warnf("rejected datagram from %s with %d pairs, at most %d are allowed", source, pairs, m.cfg.MaxPairs)
+	m.metrics.tooManyPairs.Inc()
+	if state := m.source(source, now); state != nil {
+		m.violate(source, state, now)
+	}
+
+	return false
+}
+
+// AllowTopics returns telemetry values of topics the source is allowed to
+// write, rejecting new topics over the limit.
+func (m *limiter) AllowTopics(source string, values []*tm.Telemetry, now time.Time) []*tm.Telemetry {
+	if m.cfg.MaxTopics == 0 {
+		return values
+	}
+
+	state := m.source(source, now)
+
+	allowed := values[:0]
+	rejected := 0
+	for _, telemetry := range values {
+		if _, ok := state.topics[telemetry.Topic]; !ok {
+			if len(state.topics) >= m.cfg.MaxTopics {
+				m.log.Warnf("rejected topic %s from %s, at most %d topics are allowed", telemetry.Topic, source, m.cfg.MaxTopics)
+				rejected++
+				continue
+			}
+			state.topics[telemetry.Topic] = struct{}{}
+		}
+
+		allowed = append(allowed, telemetry)
+	}
+
+	if rejected > 0 {
+		m.metrics.tooManyTopics.Add(uint64(rejected))
+		m.violate(source, state, now)
+	}
+
+	return allowed
+}
+
+func (m *limiter) source(source string, now time.Time) *sourceState {
+	if !m.cfg.tracksSources() {
+		return nil
+	}
+
+	state, ok := m.sources[source]
+	if !ok {
+		state = &sourceState{
+			topics: map[string]struct{}{},
+		}
+		if m.cfg.SourceRate > 0 {
+			state.bucket = newTokenBucket(m.cfg.SourceRate, m.cfg.SourceBurst, now)
+		}
+		m.sources[source] = state
+	}
+	state.lastSeen = now
+
+	return state
+}
+
+// violate records the violation of limits, banning the source if it is a
+// repeat offender.
+func (m *limiter) violate(source string, state *sourceState, now time.Time) {
+	if !m.cfg.bansEnabled() {
+		return
+	}
+
+	if now.Sub(state.violationsSince) > m.cfg.banWindow() {
+		state.violations = 0
+		state.violationsSince = now
+	}
+
+	state.violations++
+	if state.violations < m.cfg.BanThreshold {
+		return
+	}
+
+	state.violations = 0
+	state.bannedUntil = now.Add(m.cfg.BanDuration)
+
+	m.log.Warnf("banned %s for %s after %d limit violations within %s", source, m.cfg.BanDuration, m.cfg.BanThreshold, m.cfg.banWindow())
+	m.metrics.bans.Inc()
+}
+
+// cleanup forgets idle sources, so spoofed addresses can not exhaust
+// memory.
+func (m *limiter) cleanup(now time.Time) {
+	if now.Sub(m.lastCleanup) < limiterCleanupInterval {
+		return
+	}
+	m.lastCleanup = now
+
+	for source, state := range m.sources {
+		if now.Sub(state.lastSeen) > sourceIdleTimeout && !now.Before(state.bannedUntil) {
+			delete(m.sources, source)
+		}
+	}
+}
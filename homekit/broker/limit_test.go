@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+func newTestLimiter(cfg *UDPLimitsConfig) *limiter {
+	return newLimiter(cfg, metrics.NewRegistry(), "test", zap.NewNop().Sugar())
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	bucket := newTokenBucket(2, 3, now)
+
+	for id := 0; id < 3; id++ {
+		assert.True(t, bucket.Allow(now))
+	}
+	assert.False(t, bucket.Allow(now))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, bucket.Allow(now))
+	assert.False(t, bucket.Allow(now))
+
+	// Tokens never exceed the burst.
+	now = now.Add(time.Hour)
+	for id := 0; id < 3; id++ {
+		assert.True(t, bucket.Allow(now))
+	}
+	assert.False(t, bucket.Allow(now))
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{})
+	now := time.Now()
+
+	for id := 0; id < 1000; id++ {
+		assert.True(t, limiter.AllowDatagram("192.168.1.10", now))
+	}
+	assert.True(t, limiter.AllowPairs("192.168.1.10", 1000, now))
+	assert.Empty(t, limiter.sources)
+}
+
+func TestLimiterSourceRate(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{SourceRate: 1, SourceBurst: 2})
+	now := time.Now()
+
+	assert.True(t, limiter.AllowDatagram("192.168.1.10", now))
+	assert.True(t, limiter.AllowDatagram("192.168.1.10", now))
+	assert.False(t, limiter.AllowDatagram("192.168.1.10", now))
+
+	// Other sources have their own buckets.
+	assert.True(t, limiter.AllowDatagram("192.168.1.20", now))
+
+	assert.True(t, limiter.AllowDatagram("192.168.1.10", now.Add(time.Second)))
+}
+
+func TestLimiterGlobalRate(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{GlobalRate: 2})
+	now := time.Now()
+
+	assert.True(t, limiter.AllowDatagram("192.168.1.10", now))
+	assert.True(t, limiter.AllowDatagram("192.168.1.20", now))
+	assert.False(t, limiter.AllowDatagram("192.168.1.30", now))
+}
+
+func TestLimiterPairs(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{MaxPairs: 2})
+	now := time.Now()
+
+	assert.True(t, limiter.AllowPairs("192.168.1.10", 2, now))
+	assert.False(t, limiter.AllowPairs("192.168.1.10", 3, now))
+}
+
+func TestLimiterTopics(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{MaxTopics: 2})
+	now := time.Now()
+
+	values := limiter.AllowTopics("192.168.1.10", []*tm.Telemetry{
+		tm.NewTelemetry("/home/temp", tm.Float(21)),
+		tm.NewTelemetry("/home/humidity", tm.Float(40)),
+		tm.NewTelemetry("/home/co2", tm.Float(400)),
+	}, now)
+	assert.Equal(t, []string{"/home/temp", "/home/humidity"}, topicsOf(values))
+
+	// Known topics are still allowed.
+	values = limiter.AllowTopics("192.168.1.10", []*tm.Telemetry{
+		tm.NewTelemetry("/home/co2", tm.Float(400)),
+		tm.NewTelemetry("/home/temp", tm.Float(22)),
+	}, now)
+	assert.Equal(t, []string{"/home/temp"}, topicsOf(values))
+
+	values = limiter.AllowTopics("192.168.1.20", []*tm.Telemetry{
+		tm.NewTelemetry("/home/co2", tm.Float(400)),
+	}, now)
+	assert.Equal(t, []string{"/home/co2"}, topicsOf(values))
+}
+
+func TestLimiterBan(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{
+		SourceRate:   1,
+		BanThreshold: 3,
+		BanDuration:  time.Minute,
+	})
+	now := time.Now()
+
+	assert.True(t, limiter.AllowDatagram("192.168.1.10", now))
+	for id := 0; id < 3; id++ {
+		assert.False(t, limiter.AllowDatagram("192.168.1.10", now))
+	}
+	assert.Equal(t, uint64(1), limiter.metrics.bans.Value())
+
+	// Banned sources are rejected even if their bucket is full again.
+	assert.False(t, limiter.AllowDatagram("192.168.1.10", now.Add(30*time.Second)))
+	assert.True(t, limiter.AllowDatagram("192.168.1.10", now.Add(61*time.Second)))
+}
+
+func TestLimiterViolationsExpire(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{
+		MaxPairs:     1,
+		BanThreshold: 2,
+		BanWindow:    time.Second,
+		BanDuration:  time.Minute,
+	})
+	now := time.Now()
+
+	assert.False(t, limiter.AllowPairs("192.168.1.10", 2, now))
+	assert.False(t, limiter.AllowPairs("192.168.1.10", 2, now.Add(2*time.Second)))
+	assert.True(t, limiter.AllowDatagram("192.168.1.10", now.Add(2*time.Second)))
+
+	assert.False(t, limiter.AllowPairs("192.168.1.10", 2, now.Add(2*time.Second)))
+	assert.False(t, limiter.AllowDatagram("192.168.1.10", now.Add(2*time.Second)))
+}
+
+func TestLimiterCleanup(t *testing.T) {
+	limiter := newTestLimiter(&UDPLimitsConfig{SourceRate: 1})
+	now := time.Now()
+
+	limiter.AllowDatagram("192.168.1.10", now)
+	limiter.AllowDatagram("192.168.1.20", now.Add(sourceIdleTimeout))
+	limiter.AllowDatagram("192.168.1.20", now.Add(sourceIdleTimeout+limiterCleanupInterval+time.Second))
+
+	assert.Len(t, limiter.sources, 1)
+	assert.Contains(t, limiter.sources, "192.168.1.20")
+}
+
+func TestUDPLimitsConfigValidate(t *testing.T) {
+	assert.NoError(t, (&UDPLimitsConfig{}).Validate())
+	assert.Error(t, (&UDPLimitsConfig{SourceRate: -1}).Validate())
+	assert.Error(t, (&UDPLimitsConfig{MaxPairs: -1}).Validate())
+	assert.Error(t, (&UDPLimitsConfig{BanThreshold: 3}).Validate())
+}
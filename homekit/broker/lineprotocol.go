@@ -0,0 +1,510 @@
+package broker
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	DefaultLineProtocolTemplate = "/{measurement}/{field}"
+
+	lineProtocolMaxDatagramSize = 64 * 1024
+)
+
+// LineProtocolConfig describes the InfluxDB line protocol listener.
+type LineProtocolConfig struct {
+	// UDPAddr is the UDP listen address, like ":8089", optional.
+	UDPAddr string `yaml:"udp_addr"`
+	// HTTPAddr is the HTTP listen address, like ":8086", optional.
+	//
+	// The endpoint mimics InfluxDB 1.x, i.e. "POST /write" with the
+	// "precision" query parameter, "/ping" and a no-op "/query", so Telegraf
+	// agents can be pointed at it as is.
+	HTTPAddr string `yaml:"http_addr"`
+	// Template maps measurement, field and tags to the topic, like
+	// "/sensors/{host}/{measurement}/{field}".
+	//
+	// Tags not mentioned in the template are kept as labels.
+	//
+	// Defaults to "/{measurement}/{field}".
+	Template string
+	// Precision of timestamps received via UDP, one of "ns", "u", "ms",
+	// "s", "m" or "h".
+	//
+	// Defaults to "ns".
+	Precision  string
+	Timestamps TimestampConfig
+}
+
+func (m *LineProtocolConfig) Validate() error {
+	if len(m.UDPAddr) == 0 && len(m.HTTPAddr) == 0 {
+		return fmt.Errorf("either UDP or HTTP address is required for line protocol listener")
+	}
+
+	if err := validatePrecision(m.Precision); err != nil {
+		return err
+	}
+
+	if _, err := compileTopicTemplate(m.template()); err != nil {
+		return err
+	}
+
+	return m.Timestamps.Validate()
+}
+
+func (m *LineProtocolConfig) template() string {
+	if len(m.Template) == 0 {
+		return DefaultLineProtocolTemplate
+	}
+
+	return m.Template
+}
+
+func validatePrecision(precision string) error {
+	switch precision {
+	case "", "n", "ns", "u", "ms", "s", "m", "h":
+		return nil
+	default:
+		return fmt.Errorf("unknown precision: %s", precision)
+	}
+}
+
+// topicTemplate renders topics from line protocol points.
+//
+// Placeholders are enclosed in braces: "{measurement}" and "{field}" are
+// substituted with the measurement and field names, any other placeholder
+// is substituted with the value of the tag with such name.
+type topicTemplate struct {
+	// Segments alternate between literals and placeholders, starting with
+	// a literal, which may be empty.
+	segments []string
+	tags     map[string]bool
+}
+
+func compileTopicTemplate(template string) (*topicTemplate, error) {
+	topicTemplate := &topicTemplate{
+		tags: map[string]bool{},
+	}
+
+	hasField := false
+	rest := template
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			if strings.IndexByte(rest, '}') >= 0 {
+				return nil, fmt.Errorf("unbalanced braces in topic template %s", template)
+			}
+			topicTemplate.segments = append(topicTemplate.segments, rest)
+			break
+		}
+
+		close := strings.IndexByte(rest[open:], '}')
+		if close < 0 || strings.IndexByte(rest[:open], '}') >= 0 {
+			return nil, fmt.Errorf("unbalanced braces in topic template %s", template)
+		}
+
+		name := rest[open+1 : open+close]
+		switch name {
+		case "":
+			return nil, fmt.Errorf("empty placeholder in topic template %s", template)
+		case "measurement":
+		case "field":
+			hasField = true
+		default:
+			topicTemplate.tags[name] = true
+		}
+
+		topicTemplate.segments = append(topicTemplate.segments, rest[:open], name)
+		rest = rest[open+close+1:]
+	}
+
+	if !hasField {
+		return nil, fmt.Errorf("topic template %s must contain {field} placeholder", template)
+	}
+
+	return topicTemplate, nil
+}
+
+// Render renders the topic, returning tags not consumed by the template as
+// labels.
+func (m *topicTemplate) Render(measurement, field string, tags map[string]string) (string, tm.Labels, error) {
+	topic := strings.Builder{}
+	for id, segment := range m.segments {
+		if id%2 == 0 {
+			topic.WriteString(segment)
+			continue
+		}
+
+		switch segment {
+		case "measurement":
+			topic.WriteString(measurement)
+		case "field":
+			topic.WriteString(field)
+		default:
+			v, ok := tags[segment]
+			if !ok {
+				return "", nil, fmt.Errorf("missing tag %s", segment)
+			}
+			topic.WriteString(v)
+		}
+	}
+
+	if tm.IsWildcard(topic.String()) {
+		return "", nil, fmt.Errorf("wildcards are not allowed in topic %s", topic.String())
+	}
+
+	var labels tm.Labels
+	for k, v := range tags {
+		if m.tags[k] {
+			continue
+		}
+		if labels == nil {
+			labels = tm.Labels{}
+		}
+		labels[k] = v
+	}
+
+	return topic.String(), labels, nil
+}
+
+// lineProtocolDecoder decodes InfluxDB line protocol into telemetry values,
+// one per field.
+type lineProtocolDecoder struct {
+	Template   *topicTemplate
+	Timestamps *TimestampConfig
+	// Now returns the receive time, overridden in tests.
+	Now func() time.Time
+}
+
+func newLineProtocolDecoder(cfg *LineProtocolConfig) (*lineProtocolDecoder, error) {
+	template, err := compileTopicTemplate(cfg.template())
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := &lineProtocolDecoder{
+		Template:   template,
+		Timestamps: &cfg.Timestamps,
+		Now:        time.Now,
+	}
+
+	return decoder, nil
+}
+
+// Decode decodes the given lines, skipping invalid ones.
+//
+// The returned error describes all skipped lines and fields, while the
+// telemetry values decoded successfully are returned anyway.
+func (m *lineProtocolDecoder) Decode(buf []byte, precision string) ([]*tm.Telemetry, error) {
+	now := m.Now()
+
+	points, err := models.ParsePointsWithPrecision(buf, now, precision)
+
+	var failed []string
+	if err != nil {
+		failed = append(failed, err.Error())
+	}
+
+	var tmVec []*tm.Telemetry
+	for _, point := range points {
+		telemetries, err := m.decodePoint(point, now)
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+
+		tmVec = append(tmVec, telemetries...)
+	}
+
+	if len(failed) != 0 {
+		return tmVec, fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+
+	return tmVec, nil
+}
+
+func (m *lineProtocolDecoder) decodePoint(point models.Point, now time.Time) ([]*tm.Telemetry, error) {
+	measurement := string(point.Name())
+	tags := point.Tags().Map()
+
+	fields, err := point.Fields()
+	if err != nil {
+		return nil, fmt.Errorf("invalid fields of %s: %v", measurement, err)
+	}
+
+	timestamp, err := m.Timestamps.resolve(point.Time(), now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp of %s: %v", measurement, err)
+	}
+
+	// Keep the order stable for logging and tests.
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tmVec []*tm.Telemetry
+	var failed []string
+	for _, name := range names {
+		topic, labels, err := m.Template.Render(measurement, name, tags)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("invalid topic of %s.%s: %v", measurement, name, err))
+			continue
+		}
+
+		value, err := lineProtocolValue(fields[name])
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("invalid value of %s.%s: %v", measurement, name, err))
+			continue
+		}
+
+		telemetry := &tm.Telemetry{
+			Topic:     topic,
+			Value:     value,
+			Labels:    labels,
+			Timestamp: timestamp,
+		}
+		tmVec = append(tmVec, telemetry)
+	}
+
+	if len(failed) != 0 {
+		return tmVec, fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+
+	return tmVec, nil
+}
+
+func lineProtocolValue(v interface{}) (tm.TelemetryValue, error) {
+	switch v := v.(type) {
+	case float64:
+		return tm.Float(v), nil
+	case int64:
+		return tm.Int(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return tm.TelemetryValue{}, fmt.Errorf("unsigned value %d overflows", v)
+		}
+		return tm.Int(int64(v)), nil
+	case bool:
+		return tm.Bool(v), nil
+	case string:
+		return tm.String(v), nil
+	default:
+		return tm.TelemetryValue{}, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// lineProtocolBroker accepts InfluxDB line protocol, i.e.
+// "<measurement>[,<tag>=<value>...] <field>=<value>[,...] [<timestamp>]",
+// via UDP and/or HTTP, which makes it a drop-in replacement for InfluxDB
+// for Telegraf-like agents.
+type lineProtocolBroker struct {
+	cfg *LineProtocolConfig
+	log *zap.SugaredLogger
+}
+
+func NewLineProtocolBroker(cfg *LineProtocolConfig, log *zap.SugaredLogger) *lineProtocolBroker {
+	return &lineProtocolBroker{
+		cfg: cfg,
+		log: log,
+	}
+}
+
+func (m *lineProtocolBroker) Run(ctx context.Context, storage *tm.TelemetryStorage) error {
+	if err := m.cfg.Validate(); err != nil {
+		return err
+	}
+
+	var sock net.PacketConn
+	if len(m.cfg.UDPAddr) != 0 {
+		var err error
+		sock, err = net.ListenPacket("udp", m.cfg.UDPAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	var listener net.Listener
+	if len(m.cfg.HTTPAddr) != 0 {
+		var err error
+		listener, err = net.Listen("tcp", m.cfg.HTTPAddr)
+		if err != nil {
+			if sock != nil {
+				sock.Close()
+			}
+			return err
+		}
+	}
+
+	wg, ctx := errgroup.WithContext(ctx)
+
+	if sock != nil {
+		wg.Go(func() error {
+			return m.runUDP(ctx, sock, storage)
+		})
+		wg.Go(func() error {
+			<-ctx.Done()
+			if err := sock.Close(); err != nil {
+				m.log.Warnf("failed to close UDP socket: %v", err)
+			}
+			return ctx.Err()
+		})
+	}
+
+	if listener != nil {
+		wg.Go(func() error {
+			return m.serveHTTP(ctx, listener, storage)
+		})
+	}
+
+	return wg.Wait()
+}
+
+// This function MUST never finish with "nil" error.
+func (m *lineProtocolBroker) runUDP(ctx context.Context, sock net.PacketConn, storage *tm.TelemetryStorage) error {
+	decoder, err := newLineProtocolDecoder(m.cfg)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, lineProtocolMaxDatagramSize)
+	for {
+		nRead, remoteAddr, err := sock.ReadFrom(buf[:])
+		if err != nil {
+			return err
+		}
+
+		m.log.Debugf("received %d bytes from %s", nRead, remoteAddr)
+
+		values, err := decoder.Decode(buf[:nRead], m.cfg.Precision)
+		if err != nil {
+			m.log.Warnf("failed to parse line protocol from %s: %v", remoteAddr, err)
+		}
+
+		if len(values) > 0 {
+			storage.PutMulti(values)
+		}
+	}
+}
+
+func (m *lineProtocolBroker) serveHTTP(ctx context.Context, listener net.Listener, storage *tm.TelemetryStorage) error {
+	handler, err := m.handler(storage)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		return server.Serve(listener)
+	})
+
+	<-ctx.Done()
+	if err := server.Close(); err != nil {
+		m.log.Warnf("failed to close HTTP server: %v", err)
+	}
+
+	return wg.Wait()
+}
+
+func (m *lineProtocolBroker) handler(storage *tm.TelemetryStorage) (http.Handler, error) {
+	decoder, err := newLineProtocolDecoder(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(wr http.ResponseWriter, req *http.Request) {
+		wr.WriteHeader(http.StatusNoContent)
+	})
+	// Telegraf issues "CREATE DATABASE" on startup, there is nothing to
+	// create here.
+	mux.HandleFunc("/query", func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	})
+	mux.HandleFunc("/write", func(wr http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			wr.Header().Set("Allow", http.MethodPost)
+			m.writeError(wr, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		precision := req.URL.Query().Get("precision")
+		if err := validatePrecision(precision); err != nil {
+			m.writeError(wr, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var body io.Reader = http.MaxBytesReader(wr, req.Body, httpMaxBodySize)
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(body)
+			if err != nil {
+				m.writeError(wr, http.StatusBadRequest, err.Error())
+				return
+			}
+			defer gzipReader.Close()
+
+			// Reading a byte past the limit tells the oversized body from
+			// the one that fits exactly.
+			body = io.LimitReader(gzipReader, httpMaxBodySize+1)
+		}
+
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			m.writeError(wr, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if len(buf) > httpMaxBodySize {
+			m.writeError(wr, http.StatusRequestEntityTooLarge, "decompressed request body too large")
+			return
+		}
+
+		values, err := decoder.Decode(buf, precision)
+		if len(values) > 0 {
+			storage.PutMulti(values)
+		}
+
+		if err != nil {
+			m.log.Warnf("failed to parse line protocol from %s: %v", req.RemoteAddr, err)
+			// Mimic InfluxDB, which writes valid points and reports the
+			// rest as a partial write.
+			m.writeError(wr, http.StatusBadRequest, fmt.Sprintf("partial write: %v", err))
+			return
+		}
+
+		wr.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux, nil
+}
+
+func (m *lineProtocolBroker) writeError(wr http.ResponseWriter, status int, message string) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+
+	if err := json.NewEncoder(wr).Encode(map[string]string{"error": message}); err != nil {
+		m.log.Debugf("failed to write HTTP response: %v", err)
+	}
+}
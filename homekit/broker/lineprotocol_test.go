@@ -0,0 +1,194 @@
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+func TestCompileTopicTemplate(t *testing.T) {
+	for _, template := range []string{
+		"/{measurement}/{field}",
+		"/sensors/{host}/{field}",
+		"{field}",
+	} {
+		_, err := compileTopicTemplate(template)
+		assert.NoError(t, err, template)
+	}
+
+	for _, template := range []string{
+		"/{measurement}",
+		"/{measurement/{field}",
+		"/measurement}/{field}",
+		"/{}/{field}",
+		"",
+	} {
+		_, err := compileTopicTemplate(template)
+		assert.Error(t, err, template)
+	}
+}
+
+func TestTopicTemplateRender(t *testing.T) {
+	template, err := compileTopicTemplate("/sensors/{host}/{measurement}/{field}")
+	require.NoError(t, err)
+
+	topic, labels, err := template.Render("cpu", "usage", map[string]string{"host": "pi", "core": "0"})
+	require.NoError(t, err)
+	assert.Equal(t, "/sensors/pi/cpu/usage", topic)
+	assert.Equal(t, tm.Labels{"core": "0"}, labels)
+
+	topic, labels, err = template.Render("cpu", "usage", map[string]string{"host": "pi"})
+	require.NoError(t, err)
+	assert.Equal(t, "/sensors/pi/cpu/usage", topic)
+	assert.Nil(t, labels)
+
+	_, _, err = template.Render("cpu", "usage", map[string]string{})
+	assert.Error(t, err)
+
+	_, _, err = template.Render("cpu", "usage", map[string]string{"host": "+"})
+	assert.Error(t, err)
+}
+
+func TestLineProtocolDecode(t *testing.T) {
+	decoder, err := newLineProtocolDecoder(&LineProtocolConfig{})
+	require.NoError(t, err)
+
+	now := time.Unix(1560000000, 0)
+	decoder.Now = func() time.Time { return now }
+
+	values, err := decoder.Decode([]byte("climate,room=kitchen temp=21.5,humidity=40i,heating=true,mode=\"eco\" 1559990000000000000\n"), "")
+	require.NoError(t, err)
+	require.Len(t, values, 4)
+
+	expected := []*tm.Telemetry{
+		{Topic: "/climate/heating", Value: tm.Bool(true)},
+		{Topic: "/climate/humidity", Value: tm.Int(40)},
+		{Topic: "/climate/mode", Value: tm.String("eco")},
+		{Topic: "/climate/temp", Value: tm.Float(21.5)},
+	}
+	for id, value := range values {
+		assert.Equal(t, expected[id].Topic, value.Topic)
+		assert.Equal(t, expected[id].Value, value.Value)
+		assert.Equal(t, tm.Labels{"room": "kitchen"}, value.Labels)
+		// Sensor-side timestamps are ignored by default.
+		assert.True(t, now.Equal(value.Timestamp))
+	}
+}
+
+func TestLineProtocolDecodeTimestampPrecision(t *testing.T) {
+	decoder, err := newLineProtocolDecoder(&LineProtocolConfig{
+		Timestamps: TimestampConfig{MaxSkew: 24 * time.Hour},
+	})
+	require.NoError(t, err)
+
+	now := time.Unix(1560000000, 0)
+	decoder.Now = func() time.Time { return now }
+
+	values, err := decoder.Decode([]byte("cpu usage=0.5 1559990000"), "s")
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+	assert.Equal(t, int64(1559990000), values[0].Timestamp.Unix())
+}
+
+func TestLineProtocolDecodePartial(t *testing.T) {
+	decoder, err := newLineProtocolDecoder(&LineProtocolConfig{Template: "/{host}/{field}"})
+	require.NoError(t, err)
+
+	values, err := decoder.Decode([]byte(strings.Join([]string{
+		"cpu,host=pi usage=0.5",
+		"cpu usage=0.5",
+		"garbage",
+		"mem,host=pi used=1024i",
+	}, "\n")), "")
+	assert.Error(t, err)
+	require.Len(t, values, 2)
+	assert.Equal(t, "/pi/usage", values[0].Topic)
+	assert.Equal(t, "/pi/used", values[1].Topic)
+}
+
+func lineProtocolRequest(t *testing.T, storage *tm.TelemetryStorage, req *http.Request) *httptest.ResponseRecorder {
+	handler, err := NewLineProtocolBroker(&LineProtocolConfig{HTTPAddr: ":0"}, zap.NewNop().Sugar()).handler(storage)
+	require.NoError(t, err)
+
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, req)
+
+	return wr
+}
+
+func TestLineProtocolHTTPWrite(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	req := httptest.NewRequest(http.MethodPost, "/write?db=telegraf&precision=s", strings.NewReader("cpu,host=pi usage=0.5 1560000000\n"))
+	wr := lineProtocolRequest(t, storage, req)
+	assert.Equal(t, http.StatusNoContent, wr.Code)
+
+	telemetries := storage.Read("/cpu/usage")
+	require.Len(t, telemetries, 1)
+	assert.Equal(t, tm.Float(0.5), telemetries[0].Value)
+	assert.Equal(t, tm.Labels{"host": "pi"}, telemetries[0].Labels)
+}
+
+func TestLineProtocolHTTPWriteGzip(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	buf := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buf)
+	_, err := gzipWriter.Write([]byte("cpu usage=0.5\n"))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/write", buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	wr := lineProtocolRequest(t, storage, req)
+	assert.Equal(t, http.StatusNoContent, wr.Code)
+	assert.Len(t, storage.Read("/cpu/usage"), 1)
+}
+
+func TestLineProtocolHTTPWriteGzipTooLarge(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	buf := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buf)
+	_, err := gzipWriter.Write(bytes.Repeat([]byte("cpu usage=0.5\n"), httpMaxBodySize/14+1))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/write", buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	wr := lineProtocolRequest(t, storage, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, wr.Code)
+	assert.Empty(t, storage.Read("/cpu/usage"))
+}
+
+func TestLineProtocolHTTPPartialWrite(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	req := httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("cpu usage=0.5\ngarbage\n"))
+	wr := lineProtocolRequest(t, storage, req)
+	assert.Equal(t, http.StatusBadRequest, wr.Code)
+	assert.Contains(t, wr.Body.String(), "partial write")
+	assert.Len(t, storage.Read("/cpu/usage"), 1)
+}
+
+func TestLineProtocolHTTPPing(t *testing.T) {
+	wr := lineProtocolRequest(t, tm.NewTelemetryStorage(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+	assert.Equal(t, http.StatusNoContent, wr.Code)
+}
+
+func TestLineProtocolConfigValidate(t *testing.T) {
+	assert.Error(t, (&LineProtocolConfig{}).Validate())
+	assert.Error(t, (&LineProtocolConfig{UDPAddr: ":8089", Precision: "d"}).Validate())
+	assert.Error(t, (&LineProtocolConfig{UDPAddr: ":8089", Template: "/{measurement}"}).Validate())
+	assert.NoError(t, (&LineProtocolConfig{UDPAddr: ":8089", Precision: "ms"}).Validate())
+}
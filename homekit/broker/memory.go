@@ -2,34 +2,207 @@ package broker
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
+	"homekit-ng/homekit/metrics"
 	"homekit-ng/homekit/tm"
 )
 
+const defaultMemoryCapacity = 128
 
+// MemoryOverflowPolicy describes what happens with telemetry added to the
+// full MemoryBroker.
+type MemoryOverflowPolicy string
+
+const (
+	// MemoryBlock blocks until there is room.
+	MemoryBlock MemoryOverflowPolicy = "block"
+	// MemoryDrop drops telemetry that does not fit.
+	MemoryDrop MemoryOverflowPolicy = "drop"
+	// MemoryCoalesce keeps only the latest pending value of each series,
+	// dropping new series that do not fit.
+	MemoryCoalesce MemoryOverflowPolicy = "coalesce"
+)
+
+type MemoryConfig struct {
+	// Capacity is the maximum number of pending telemetry values.
+	//
+	// Defaults to 128.
+	Capacity int
+	// Policy defaults to "coalesce".
+	Policy MemoryOverflowPolicy
+}
+
+func (m *MemoryConfig) Validate() error {
+	if m.Capacity < 0 {
+		return fmt.Errorf("negative memory broker capacity: %d", m.Capacity)
+	}
+
+	switch m.Policy {
+	case MemoryBlock, MemoryDrop, MemoryCoalesce, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown memory broker overflow policy: %s", m.Policy)
+	}
+}
+
+// MemoryStats describes what happened to telemetry added to the
+// MemoryBroker.
+type MemoryStats struct {
+	// Dropped is the number of values that did not fit.
+	Dropped uint64
+	// Coalesced is the number of values replaced by newer values of the
+	// same series before reaching the storage.
+	Coalesced uint64
+}
+
+// MemoryBroker passes telemetry produced within the process into the
+// storage.
 type MemoryBroker struct {
-	txrx chan *tm.Telemetry
+	capacity int
+	policy   MemoryOverflowPolicy
+
+	mu      sync.Mutex
+	space   *sync.Cond
+	pending []*tm.Telemetry
+	// index maps series keys to positions of pending values, maintained
+	// only for the coalescing policy.
+	index  map[string]int
+	stats  MemoryStats
+	closed bool
+	// notify wakes up Run when there are pending values.
+	notify chan struct{}
 }
 
-func NewMemoryBroker() *MemoryBroker {
-	return &MemoryBroker{
-		txrx: make(chan *tm.Telemetry, 128),
+func NewMemoryBroker(cfg *MemoryConfig) (*MemoryBroker, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	capacity := cfg.Capacity
+	if capacity == 0 {
+		capacity = defaultMemoryCapacity
+	}
+
+	policy := cfg.Policy
+	if len(policy) == 0 {
+		policy = MemoryCoalesce
+	}
+
+	broker := &MemoryBroker{
+		capacity: capacity,
+		policy:   policy,
+		index:    map[string]int{},
+		notify:   make(chan struct{}, 1),
 	}
+	broker.space = sync.NewCond(&broker.mu)
+
+	metrics.Default.CounterFunc("memory/dropped", nil, func() uint64 {
+		return broker.Stats().Dropped
+	})
+	metrics.Default.CounterFunc("memory/coalesced", nil, func() uint64 {
+		return broker.Stats().Coalesced
+	})
+
+	return broker, nil
 }
 
-func (m *MemoryBroker) Add(topic string, value float64) {
-	m.txrx <- tm.NewTelemetry(topic, value)
+func (m *MemoryBroker) Add(topic string, value tm.TelemetryValue) {
+	m.AddMulti([]*tm.Telemetry{tm.NewTelemetry(topic, value)})
+}
+
+// AddMulti adds the batch of telemetry values according to the overflow
+// policy.
+//
+// With the blocking policy it blocks until there is room, unless the
+// broker is not running anymore, in which case values are dropped.
+func (m *MemoryBroker) AddMulti(telemetries []*tm.Telemetry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, telemetry := range telemetries {
+		m.add(telemetry)
+	}
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *MemoryBroker) add(telemetry *tm.Telemetry) {
+	if m.policy == MemoryCoalesce {
+		if id, ok := m.index[telemetry.Key()]; ok {
+			m.pending[id] = telemetry
+			m.stats.Coalesced++
+			return
+		}
+	}
+
+	for len(m.pending) >= m.capacity {
+		if m.policy != MemoryBlock || m.closed {
+			m.stats.Dropped++
+			return
+		}
+
+		// Let Run drain what is already pending.
+		select {
+		case m.notify <- struct{}{}:
+		default:
+		}
+		m.space.Wait()
+	}
+
+	if m.policy == MemoryCoalesce {
+		m.index[telemetry.Key()] = len(m.pending)
+	}
+	m.pending = append(m.pending, telemetry)
+}
+
+// Stats returns counters of dropped and coalesced values.
+func (m *MemoryBroker) Stats() MemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stats
 }
 
 func (m *MemoryBroker) Run(ctx context.Context, storage *tm.TelemetryStorage) error {
+	m.mu.Lock()
+	m.closed = false
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.closed = true
+		m.space.Broadcast()
+		m.mu.Unlock()
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case ev := <-m.txrx:
-			storage.PutMulti([]*tm.Telemetry{ev})
+		case <-m.notify:
+			if batch := m.drain(); len(batch) > 0 {
+				storage.PutMulti(batch)
+			}
 		}
 	}
 }
 
+// drain takes all pending values, waking up blocked writers.
+func (m *MemoryBroker) drain() []*tm.Telemetry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	batch := m.pending
+	m.pending = make([]*tm.Telemetry, 0, len(batch))
+	if len(m.index) != 0 {
+		m.index = map[string]int{}
+	}
+	m.space.Broadcast()
+
+	return batch
+}
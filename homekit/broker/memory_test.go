@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+func newMemoryBroker(t *testing.T, cfg *MemoryConfig) *MemoryBroker {
+	broker, err := NewMemoryBroker(cfg)
+	require.NoError(t, err)
+
+	return broker
+}
+
+func runMemoryBroker(broker *MemoryBroker, storage *tm.TelemetryStorage) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		broker.Run(ctx, storage)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestMemoryBrokerRun(t *testing.T) {
+	broker := newMemoryBroker(t, &MemoryConfig{})
+	storage := tm.NewTelemetryStorage()
+
+	stop := runMemoryBroker(broker, storage)
+	defer stop()
+
+	broker.AddMulti([]*tm.Telemetry{
+		tm.NewTelemetry("/home/activity/a", tm.Float(1)),
+		tm.NewTelemetry("/home/activity/b", tm.Float(0)),
+	})
+	broker.Add("/home/temp", tm.Float(21.5))
+
+	assert.Equal(t, tm.Float(1), waitTelemetry(t, storage, "/home/activity/a").Value)
+	assert.Equal(t, tm.Float(0), waitTelemetry(t, storage, "/home/activity/b").Value)
+	assert.Equal(t, tm.Float(21.5), waitTelemetry(t, storage, "/home/temp").Value)
+}
+
+func TestMemoryBrokerDrop(t *testing.T) {
+	broker := newMemoryBroker(t, &MemoryConfig{Capacity: 2, Policy: MemoryDrop})
+
+	for _, value := range []float64{1, 2, 3} {
+		broker.Add("/home/temp", tm.Float(value))
+	}
+
+	assert.Equal(t, MemoryStats{Dropped: 1}, broker.Stats())
+
+	batch := broker.drain()
+	require.Len(t, batch, 2)
+	assert.Equal(t, tm.Float(1), batch[0].Value)
+	assert.Equal(t, tm.Float(2), batch[1].Value)
+}
+
+func TestMemoryBrokerCoalesce(t *testing.T) {
+	broker := newMemoryBroker(t, &MemoryConfig{Capacity: 2})
+
+	broker.Add("/home/temp", tm.Float(1))
+	broker.Add("/home/humidity", tm.Float(40))
+	broker.Add("/home/temp", tm.Float(2))
+	broker.Add("/home/co2", tm.Float(400))
+
+	assert.Equal(t, MemoryStats{Dropped: 1, Coalesced: 1}, broker.Stats())
+
+	batch := broker.drain()
+	require.Len(t, batch, 2)
+	assert.Equal(t, "/home/temp", batch[0].Topic)
+	assert.Equal(t, tm.Float(2), batch[0].Value)
+	assert.Equal(t, "/home/humidity", batch[1].Topic)
+
+	// Coalescing starts over after draining.
+	broker.Add("/home/temp", tm.Float(3))
+	assert.Len(t, broker.drain(), 1)
+	assert.Equal(t, uint64(1), broker.Stats().Coalesced)
+}
+
+func TestMemoryBrokerBlock(t *testing.T) {
+	broker := newMemoryBroker(t, &MemoryConfig{Capacity: 1, Policy: MemoryBlock})
+	storage := tm.NewTelemetryStorage()
+
+	broker.Add("/home/temp", tm.Float(1))
+
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		broker.Add("/home/temp", tm.Float(2))
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("Add must block while the broker is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stop := runMemoryBroker(broker, storage)
+	<-added
+	stop()
+	broker.drain()
+
+	// Writers are not blocked after the broker stopped.
+	broker.Add("/home/temp", tm.Float(3))
+	broker.Add("/home/temp", tm.Float(4))
+	assert.Equal(t, uint64(1), broker.Stats().Dropped)
+}
+
+func TestMemoryConfigValidate(t *testing.T) {
+	assert.NoError(t, (&MemoryConfig{}).Validate())
+	assert.Error(t, (&MemoryConfig{Capacity: -1}).Validate())
+	assert.Error(t, (&MemoryConfig{Policy: "ignore"}).Validate())
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	defaultMQTTMinBackoff = time.Second
+	defaultMQTTMaxBackoff = 2 * time.Minute
+
+	// mqttPollInterval bounds the delay of token errors, see wait.
+	mqttPollInterval = 10 * time.Millisecond
+)
+
+type MQTTConfig struct {
+	// Addr is the MQTT server address, like "tcp://127.0.0.1:1883".
+	Addr     string
+	ClientID string `yaml:"client_id"`
+	Username string
+	Password string
+	// Subscriptions describe which MQTT topics are mapped into telemetry
+	// and how.
+	Subscriptions []*MQTTSubscription
+	// MinBackoff is the initial delay between reconnection attempts, which
+	// doubles after each failed attempt up to MaxBackoff.
+	//
+	// Defaults to 1s and 2m respectively.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (m *MQTTConfig) Validate() error {
+	if len(m.Addr) == 0 {
+		return fmt.Errorf("MQTT server address is required")
+	}
+
+	if len(m.Subscriptions) == 0 {
+		return fmt.Errorf("at least one MQTT subscription is required")
+	}
+
+	return nil
+}
+
+func (m *MQTTConfig) minBackoff() time.Duration {
+	if m.MinBackoff <= 0 {
+		return defaultMQTTMinBackoff
+	}
+
+	return m.MinBackoff
+}
+
+func (m *MQTTConfig) maxBackoff() time.Duration {
+	if m.MaxBackoff <= 0 {
+		return defaultMQTTMaxBackoff
+	}
+
+	return m.MaxBackoff
+}
+
+type MQTTSubscription struct {
+	// Filter is an MQTT topic filter, like "sensors/+/temperature".
+	Filter string
+	QoS    byte
+	// Prefix is prepended to the MQTT topic to form the telemetry topic,
+	// i.e. "sensors/kitchen/temperature" with the "/home" prefix becomes
+	// "/home/sensors/kitchen/temperature".
+	Prefix string
+	// Field is a dot-separated path to the value within a JSON payload,
+	// like "state.temperature". When empty, the payload is the value
+	// itself in the text format, see tm.ParseTelemetryValue.
+	Field string
+}
+
+// Topic maps the MQTT topic into the telemetry topic.
+func (m *MQTTSubscription) Topic(topic string) tm.Topic {
+	if !strings.HasPrefix(topic, tm.TopicSeparator) {
+		topic = tm.TopicSeparator + topic
+	}
+
+	return strings.TrimSuffix(m.Prefix, tm.TopicSeparator) + topic
+}
+
+// Decode maps the MQTT message into the telemetry.
+func (m *MQTTSubscription) Decode(topic string, payload []byte) (*tm.Telemetry, error) {
+	value, err := m.value(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload of %s: %v", topic, err)
+	}
+
+	return tm.NewTelemetry(m.Topic(topic), value), nil
+}
+
+func (m *MQTTSubscription) value(payload []byte) (tm.TelemetryValue, error) {
+	if len(m.Field) == 0 {
+		return tm.ParseTelemetryValue(string(bytes.TrimSpace(payload)))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return tm.TelemetryValue{}, err
+	}
+
+	for _, key := range strings.Split(m.Field, ".") {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return tm.TelemetryValue{}, fmt.Errorf("field %s not found", m.Field)
+		}
+
+		v, ok = object[key]
+		if !ok {
+			return tm.TelemetryValue{}, fmt.Errorf("field %s not found", m.Field)
+		}
+	}
+
+	return jsonValue(v)
+}
+
+// jsonValue converts a decoded JSON scalar into the telemetry value.
+//
+// Numbers are always floats to keep the value type stable regardless of
+// whether the sensor sends "21" or "21.5".
+func jsonValue(v interface{}) (tm.TelemetryValue, error) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return tm.TelemetryValue{}, err
+		}
+		return tm.Float(f), nil
+	case float64:
+		return tm.Float(v), nil
+	case bool:
+		return tm.Bool(v), nil
+	case string:
+		return tm.String(v), nil
+	default:
+		return tm.TelemetryValue{}, fmt.Errorf("expected a scalar value, got %T", v)
+	}
+}
+
+// mqttBroker subscribes to an MQTT server and maps incoming messages into
+// telemetry.
+type mqttBroker struct {
+	cfg *MQTTConfig
+	log *zap.SugaredLogger
+}
+
+func NewMQTTBroker(cfg *MQTTConfig, log *zap.SugaredLogger) *mqttBroker {
+	return &mqttBroker{
+		cfg: cfg,
+		log: log,
+	}
+}
+
+// Run keeps the connection to the MQTT server, reconnecting with an
+// exponential backoff.
+//
+// This function MUST never finish with "nil" error.
+func (m *mqttBroker) Run(ctx context.Context, storage *tm.TelemetryStorage) error {
+	backoff := m.cfg.minBackoff()
+
+	for {
+		connected, err := m.session(ctx, storage)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if connected {
+			backoff = m.cfg.minBackoff()
+		}
+
+		m.log.Warnf("MQTT session with %s failed, reconnecting in %s: %v", m.cfg.Addr, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > m.cfg.maxBackoff() {
+			backoff = m.cfg.maxBackoff()
+		}
+	}
+}
+
+// session connects to the MQTT server and serves subscriptions until the
+// connection is lost or the context is cancelled, reporting whether the
+// connection has been established.
+func (m *mqttBroker) session(ctx context.Context, storage *tm.TelemetryStorage) (bool, error) {
+	lost := make(chan error, 1)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.cfg.Addr).
+		SetClientID(m.cfg.ClientID).
+		SetUsername(m.cfg.Username).
+		SetPassword(m.cfg.Password).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectTimeout(10 * time.Second).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			lost <- err
+		})
+
+	client := mqtt.NewClient(opts)
+	if err := wait(ctx, client.Connect()); err != nil {
+		return false, err
+	}
+	defer client.Disconnect(250)
+
+	m.log.Infof("connected to MQTT server %s", m.cfg.Addr)
+
+	for _, subscription := range m.cfg.Subscriptions {
+		subscription := subscription
+
+		token := client.Subscribe(subscription.Filter, subscription.QoS, func(client mqtt.Client, msg mqtt.Message) {
+			telemetry, err := subscription.Decode(msg.Topic(), msg.Payload())
+			if err != nil {
+				m.log.Warnf("failed to decode MQTT message: %v", err)
+				return
+			}
+
+			storage.PutMulti([]*tm.Telemetry{telemetry})
+		})
+		if err := wait(ctx, token); err != nil {
+			return true, fmt.Errorf("failed to subscribe to %s: %v", subscription.Filter, err)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return true, ctx.Err()
+	case err := <-lost:
+		return true, err
+	}
+}
+
+// wait waits for the token to complete or the context to be cancelled.
+//
+// Token.WaitTimeout holds the token lock while waiting, which also blocks
+// the client from completing the token with an error, so it is polled with
+// a short timeout. Waiting in a separate goroutine instead would leak it
+// when the token never completes.
+func wait(ctx context.Context, token mqtt.Token) error {
+	for !token.WaitTimeout(mqttPollInterval) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	return token.Error()
+}
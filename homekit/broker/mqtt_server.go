@@ -0,0 +1,535 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	mqttProtocolLevel311 = 4
+	mqttProtocolLevel31  = 3
+
+	mqttConnectTimeout = 10 * time.Second
+	mqttWriteTimeout   = 10 * time.Second
+	// mqttOutgoingQueueSize bounds packets waiting to be written to a
+	// client, which is disconnected when it does not keep up.
+	mqttOutgoingQueueSize = 256
+
+	// defaultMQTTMaxPacketSize limits the remaining length of packets by
+	// default, which protects the memory from clients declaring huge ones.
+	defaultMQTTMaxPacketSize = 64 << 10
+)
+
+type MQTTServerConfig struct {
+	// Addr is the listen address, like ":1883".
+	Addr string
+	// Users maps usernames to passwords. When empty, anonymous clients are
+	// allowed.
+	Users map[string]string
+	// Prefix is prepended to MQTT topics to form telemetry topics.
+	Prefix string
+	// Field is a dot-separated path to the value within JSON payloads.
+	// When empty, payloads are values in the text format, see
+	// tm.ParseTelemetryValue.
+	Field string
+	// MaxPacketSize limits the remaining length of packets in bytes, which
+	// is 64KiB by default. Clients sending larger packets are disconnected.
+	MaxPacketSize int `yaml:"max_packet_size"`
+}
+
+func (m *MQTTServerConfig) Validate() error {
+	if len(m.Addr) == 0 {
+		return fmt.Errorf("address is required for MQTT server")
+	}
+
+	if m.MaxPacketSize < 0 {
+		return fmt.Errorf("negative MQTT max packet size: %d", m.MaxPacketSize)
+	}
+
+	return nil
+}
+
+func (m *MQTTServerConfig) maxPacketSize() int {
+	if m.MaxPacketSize == 0 {
+		return defaultMQTTMaxPacketSize
+	}
+
+	return m.MaxPacketSize
+}
+
+func (m *MQTTServerConfig) authenticate(connect *packets.ConnectPacket) byte {
+	if len(m.Users) == 0 {
+		return packets.Accepted
+	}
+
+	if !connect.UsernameFlag || !connect.PasswordFlag {
+		return packets.ErrRefusedNotAuthorised
+	}
+
+	password, ok := m.Users[connect.Username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), connect.Password) != 1 {
+		return packets.ErrRefusedBadUsernameOrPassword
+	}
+
+	return packets.Accepted
+}
+
+// mqttServer is an embedded MQTT 3.1.1 server, which stores every
+// published message as telemetry.
+//
+// It supports QoS 0 and 1 for incoming messages, retained messages, wills
+// and QoS 0 subscriptions. Sessions are never persisted, i.e. every
+// connection is treated as a clean session.
+type mqttServer struct {
+	cfg     *MQTTServerConfig
+	mapping *MQTTSubscription
+	log     *zap.SugaredLogger
+
+	mu       sync.Mutex
+	clients  map[string]*mqttServerClient
+	retained map[string]*packets.PublishPacket
+}
+
+func NewMQTTServer(cfg *MQTTServerConfig, log *zap.SugaredLogger) *mqttServer {
+	return &mqttServer{
+		cfg: cfg,
+		mapping: &MQTTSubscription{
+			Prefix: cfg.Prefix,
+			Field:  cfg.Field,
+		},
+		log:      log,
+		clients:  map[string]*mqttServerClient{},
+		retained: map[string]*packets.PublishPacket{},
+	}
+}
+
+func (m *mqttServer) Run(ctx context.Context, storage *tm.TelemetryStorage) error {
+	if err := m.cfg.Validate(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	return m.serve(ctx, listener, storage)
+}
+
+func (m *mqttServer) serve(ctx context.Context, listener net.Listener, storage *tm.TelemetryStorage) error {
+	m.log.Infof("serving MQTT on %s", listener.Addr())
+
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return err
+			}
+
+			go m.handle(ctx, conn, storage)
+		}
+	})
+
+	<-ctx.Done()
+	if err := listener.Close(); err != nil {
+		m.log.Warnf("failed to close MQTT listener: %v", err)
+	}
+
+	m.mu.Lock()
+	for _, client := range m.clients {
+		client.Close()
+	}
+	m.mu.Unlock()
+
+	return wg.Wait()
+}
+
+func (m *mqttServer) handle(ctx context.Context, conn net.Conn, storage *tm.TelemetryStorage) {
+	defer conn.Close()
+
+	client, err := m.connect(conn)
+	if err != nil {
+		m.log.Warnf("rejected MQTT client %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer m.disconnect(client)
+
+	m.log.Debugf("MQTT client %s connected from %s", client.id, conn.RemoteAddr())
+
+	err = m.serveClient(ctx, client, storage)
+	if err != nil && ctx.Err() == nil {
+		m.log.Debugf("MQTT client %s disconnected: %v", client.id, err)
+		// Only abnormal disconnections trigger the will.
+		if client.will != nil {
+			m.publish(client.will, storage)
+		}
+	}
+}
+
+func (m *mqttServer) connect(conn net.Conn) (*mqttServerClient, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout)); err != nil {
+		return nil, err
+	}
+
+	packet, err := readLimitedPacket(conn, m.cfg.maxPacketSize())
+	if err != nil {
+		return nil, err
+	}
+
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return nil, fmt.Errorf("expected CONNECT, got %s", packet.String())
+	}
+
+	code := connect.Validate()
+	if code == packets.Accepted && connect.ProtocolVersion != mqttProtocolLevel311 && connect.ProtocolVersion != mqttProtocolLevel31 {
+		code = packets.ErrRefusedBadProtocolVersion
+	}
+	if code == packets.Accepted {
+		code = m.cfg.authenticate(connect)
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = code
+	if err := connack.Write(conn); err != nil {
+		return nil, err
+	}
+
+	if code != packets.Accepted {
+		return nil, packets.ConnErrors[code]
+	}
+
+	client := newMQTTServerClient(connect.ClientIdentifier, conn, time.Duration(connect.Keepalive)*time.Second)
+	if len(client.id) == 0 {
+		client.id = fmt.Sprintf("anonymous-%s", conn.RemoteAddr())
+	}
+
+	if connect.WillFlag {
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = connect.WillTopic
+		will.Payload = connect.WillMessage
+		will.Qos = connect.WillQos
+		will.Retain = connect.WillRetain
+		client.will = will
+	}
+
+	go client.writeLoop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A client with the same id takes over the existing connection.
+	if previous, ok := m.clients[client.id]; ok {
+		previous.Close()
+	}
+	m.clients[client.id] = client
+
+	return client, nil
+}
+
+// readLimitedPacket reads the packet, failing before reading its body if the
+// remaining length exceeds the limit.
+func readLimitedPacket(r io.Reader, limit int) (packets.ControlPacket, error) {
+	header := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	// The remaining length is encoded in up to four bytes, seven bits each,
+	// with the high bit set on all but the last byte.
+	length := 0
+	b := make([]byte, 1)
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, fmt.Errorf("malformed remaining length")
+		}
+
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+
+		length |= int(b[0]&0x7f) << shift
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > limit {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the limit of %d bytes", length, limit)
+	}
+
+	return packets.ReadPacket(io.MultiReader(bytes.NewReader(header), r))
+}
+
+func (m *mqttServer) disconnect(client *mqttServerClient) {
+	client.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.clients[client.id] == client {
+		delete(m.clients, client.id)
+	}
+}
+
+func (m *mqttServer) serveClient(ctx context.Context, client *mqttServerClient, storage *tm.TelemetryStorage) error {
+	for {
+		if client.keepalive > 0 {
+			if err := client.conn.SetReadDeadline(time.Now().Add(client.keepalive * 3 / 2)); err != nil {
+				return err
+			}
+		} else if err := client.conn.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+
+		packet, err := readLimitedPacket(client.conn, m.cfg.maxPacketSize())
+		if err != nil {
+			return err
+		}
+
+		switch p := packet.(type) {
+		case *packets.PublishPacket:
+			if p.Qos > 1 {
+				return fmt.Errorf("QoS %d is not supported", p.Qos)
+			}
+			if tm.IsWildcard(p.TopicName) {
+				return fmt.Errorf("wildcards are not allowed in published topics: %s", p.TopicName)
+			}
+
+			m.publish(p, storage)
+
+			if p.Qos == 1 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				if err := client.Write(puback); err != nil {
+					return err
+				}
+			}
+		case *packets.SubscribePacket:
+			if err := m.subscribe(client, p); err != nil {
+				return err
+			}
+		case *packets.UnsubscribePacket:
+			client.Unsubscribe(p.Topics)
+
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			if err := client.Write(unsuback); err != nil {
+				return err
+			}
+		case *packets.PingreqPacket:
+			if err := client.Write(packets.NewControlPacket(packets.Pingresp)); err != nil {
+				return err
+			}
+		case *packets.DisconnectPacket:
+			return nil
+		default:
+			return fmt.Errorf("unexpected %s", packet.String())
+		}
+	}
+}
+
+// publish stores the message as telemetry, keeps it if retained and routes
+// it to subscribers.
+func (m *mqttServer) publish(p *packets.PublishPacket, storage *tm.TelemetryStorage) {
+	if !strings.HasPrefix(p.TopicName, "$") && len(p.Payload) > 0 {
+		telemetry, err := m.mapping.Decode(p.TopicName, p.Payload)
+		if err != nil {
+			m.log.Warnf("failed to decode MQTT message: %v", err)
+		} else {
+			storage.PutMulti([]*tm.Telemetry{telemetry})
+		}
+	}
+
+	m.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(m.retained, p.TopicName)
+		} else {
+			m.retained[p.TopicName] = p.Copy()
+		}
+	}
+
+	var subscribers []*mqttServerClient
+	for _, client := range m.clients {
+		if client.IsSubscribed(p.TopicName) {
+			subscribers = append(subscribers, client)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, client := range subscribers {
+		// Subscriptions are always granted QoS 0, and the retain flag is
+		// cleared for regular deliveries.
+		delivery := p.Copy()
+		delivery.Qos = 0
+		delivery.Retain = false
+
+		if err := client.Write(delivery); err != nil {
+			m.log.Debugf("failed to deliver MQTT message to %s: %v", client.id, err)
+		}
+	}
+}
+
+func (m *mqttServer) subscribe(client *mqttServerClient, p *packets.SubscribePacket) error {
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = p.MessageID
+
+	var patterns []*tm.Pattern
+	for _, filter := range p.Topics {
+		pattern, err := tm.CompilePattern(filter)
+		if err != nil {
+			suback.ReturnCodes = append(suback.ReturnCodes, 0x80)
+			continue
+		}
+
+		client.Subscribe(filter, pattern)
+		patterns = append(patterns, pattern)
+		suback.ReturnCodes = append(suback.ReturnCodes, 0)
+	}
+
+	if err := client.Write(suback); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	var retained []*packets.PublishPacket
+	for topic, message := range m.retained {
+		for _, pattern := range patterns {
+			if pattern.Match(topic) {
+				retained = append(retained, message)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, message := range retained {
+		delivery := message.Copy()
+		delivery.Qos = 0
+		delivery.Retain = true
+
+		if err := client.Write(delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mqttServerClient is a connected client.
+//
+// Packets are written by a separate goroutine from the bounded queue, so
+// a slow subscriber never stalls publishers.
+type mqttServerClient struct {
+	id        string
+	conn      net.Conn
+	keepalive time.Duration
+	will      *packets.PublishPacket
+
+	queue     chan packets.ControlPacket
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu            sync.Mutex
+	subscriptions map[string]*tm.Pattern
+}
+
+func newMQTTServerClient(id string, conn net.Conn, keepalive time.Duration) *mqttServerClient {
+	return &mqttServerClient{
+		id:            id,
+		conn:          conn,
+		keepalive:     keepalive,
+		queue:         make(chan packets.ControlPacket, mqttOutgoingQueueSize),
+		done:          make(chan struct{}),
+		subscriptions: map[string]*tm.Pattern{},
+	}
+}
+
+// Write queues the packet for sending, closing the client if the queue is
+// full.
+func (m *mqttServerClient) Write(packet packets.ControlPacket) error {
+	select {
+	case <-m.done:
+		return fmt.Errorf("client is closed")
+	default:
+	}
+
+	select {
+	case m.queue <- packet:
+		return nil
+	default:
+		m.Close()
+		return fmt.Errorf("outgoing queue is full")
+	}
+}
+
+// writeLoop sends queued packets until the client is closed.
+func (m *mqttServerClient) writeLoop() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case packet := <-m.queue:
+			if err := m.conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout)); err != nil {
+				m.Close()
+				return
+			}
+			if err := packet.Write(m.conn); err != nil {
+				m.Close()
+				return
+			}
+		}
+	}
+}
+
+func (m *mqttServerClient) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.conn.Close()
+	})
+}
+
+func (m *mqttServerClient) Subscribe(filter string, pattern *tm.Pattern) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subscriptions[filter] = pattern
+}
+
+func (m *mqttServerClient) Unsubscribe(filters []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, filter := range filters {
+		delete(m.subscriptions, filter)
+	}
+}
+
+func (m *mqttServerClient) IsSubscribed(topic string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pattern := range m.subscriptions {
+		if pattern.Match(topic) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+func runMQTTServer(t *testing.T, cfg *MQTTServerConfig, storage *tm.TelemetryStorage) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewMQTTServer(cfg, zap.NewNop().Sugar()).serve(ctx, listener, storage)
+	}()
+
+	return "tcp://" + listener.Addr().String(), func() {
+		cancel()
+		<-done
+	}
+}
+
+func newMQTTClient(t *testing.T, addr, username, password string) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(addr).
+		SetClientID("test-" + username).
+		SetUsername(username).
+		SetPassword(password).
+		SetProtocolVersion(4).
+		SetConnectTimeout(5 * time.Second).
+		SetAutoReconnect(false)
+
+	return mqtt.NewClient(opts)
+}
+
+func waitToken(token mqtt.Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return wait(ctx, token)
+}
+
+func TestMQTTServerPublish(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+	addr, stop := runMQTTServer(t, &MQTTServerConfig{
+		Prefix: "/home",
+		Users:  map[string]string{"esp": "secret"},
+	}, storage)
+	defer stop()
+
+	client := newMQTTClient(t, addr, "esp", "secret")
+	require.NoError(t, waitToken(client.Connect()))
+	defer client.Disconnect(100)
+
+	require.NoError(t, waitToken(client.Publish("sensors/kitchen/temp", 1, false, "21.5")))
+
+	require.NoError(t, waitToken(client.Publish("sensors/kitchen/door", 0, false, "true")))
+
+	assert.Equal(t, tm.Float(21.5), waitTelemetry(t, storage, "/home/sensors/kitchen/temp").Value)
+	assert.Equal(t, tm.Bool(true), waitTelemetry(t, storage, "/home/sensors/kitchen/door").Value)
+}
+
+func TestMQTTServerAuth(t *testing.T) {
+	addr, stop := runMQTTServer(t, &MQTTServerConfig{
+		Users: map[string]string{"esp": "secret"},
+	}, tm.NewTelemetryStorage())
+	defer stop()
+
+	for _, password := range []string{"wrong", ""} {
+		client := newMQTTClient(t, addr, "esp", password)
+		assert.Error(t, waitToken(client.Connect()))
+	}
+}
+
+func TestMQTTServerMaxPacketSize(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+	addr, stop := runMQTTServer(t, &MQTTServerConfig{MaxPacketSize: 128}, storage)
+	defer stop()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = mqttProtocolLevel311
+	connect.ClientIdentifier = "esp"
+	require.NoError(t, connect.Write(conn))
+
+	connack, err := packets.ReadPacket(conn)
+	require.NoError(t, err)
+	require.Equal(t, byte(packets.Accepted), connack.(*packets.ConnackPacket).ReturnCode)
+
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = "/home/firmware"
+	publish.Payload = []byte(`"` + strings.Repeat("x", 256) + `"`)
+	require.NoError(t, publish.Write(conn))
+
+	// The server disconnects the client without reading the packet.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = packets.ReadPacket(conn)
+	assert.Error(t, err)
+	assert.Empty(t, storage.Read("#"))
+}
+
+func TestMQTTServerSlowSubscriber(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+	addr, stop := runMQTTServer(t, &MQTTServerConfig{}, storage)
+	defer stop()
+
+	// The subscriber never reads, so its socket buffers fill up quickly.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = mqttProtocolLevel311
+	connect.ClientIdentifier = "slow"
+	require.NoError(t, connect.Write(conn))
+
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.MessageID = 1
+	subscribe.Topics = []string{"#"}
+	subscribe.Qoss = []byte{0}
+	require.NoError(t, subscribe.Write(conn))
+
+	publisher := newMQTTClient(t, addr, "publisher", "")
+	require.NoError(t, waitToken(publisher.Connect()))
+	defer publisher.Disconnect(100)
+
+	payload := `"` + strings.Repeat("x", 60000) + `"`
+	startedAt := time.Now()
+	for id := 0; id < 500; id++ {
+		require.NoError(t, waitToken(publisher.Publish("firmware", 1, false, payload)))
+	}
+	assert.True(t, time.Since(startedAt) < mqttWriteTimeout, "publisher was stalled by the slow subscriber")
+}
+
+func TestReadLimitedPacket(t *testing.T) {
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = mqttProtocolLevel311
+	connect.ClientIdentifier = strings.Repeat("x", 100)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, connect.Write(buf))
+	raw := buf.Bytes()
+
+	packet, err := readLimitedPacket(bytes.NewReader(raw), 1024)
+	require.NoError(t, err)
+	assert.Equal(t, connect.ClientIdentifier, packet.(*packets.ConnectPacket).ClientIdentifier)
+
+	_, err = readLimitedPacket(bytes.NewReader(raw), 64)
+	assert.Error(t, err)
+
+	// The body of the oversized packet is never read.
+	_, err = readLimitedPacket(bytes.NewReader([]byte{0x10, 0xff, 0xff, 0xff, 0x7f}), defaultMQTTMaxPacketSize)
+	assert.EqualError(t, err, "packet of 268435455 bytes exceeds the limit of 65536 bytes")
+
+	_, err = readLimitedPacket(bytes.NewReader([]byte{0x10, 0xff, 0xff, 0xff, 0xff, 0x01}), defaultMQTTMaxPacketSize)
+	assert.EqualError(t, err, "malformed remaining length")
+}
+
+// TestMQTTBrokerWithServer runs the MQTT subscriber broker against the
+// embedded server, checking both retained and live messages.
+func TestMQTTBrokerWithServer(t *testing.T) {
+	addr, stop := runMQTTServer(t, &MQTTServerConfig{}, tm.NewTelemetryStorage())
+	defer stop()
+
+	publisher := newMQTTClient(t, addr, "publisher", "")
+	require.NoError(t, waitToken(publisher.Connect()))
+	defer publisher.Disconnect(100)
+
+	require.NoError(t, waitToken(publisher.Publish("zigbee2mqtt/kitchen", 1, true, `{"humidity": 40}`)))
+
+	storage := tm.NewTelemetryStorage()
+	broker := NewMQTTBroker(&MQTTConfig{
+		Addr:     addr,
+		ClientID: "homekit",
+		Subscriptions: []*MQTTSubscription{
+			{Filter: "zigbee2mqtt/+", Prefix: "/home", Field: "humidity"},
+		},
+	}, zap.NewNop().Sugar())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- broker.Run(ctx, storage)
+	}()
+
+	assert.Equal(t, tm.Float(40), waitTelemetry(t, storage, "/home/zigbee2mqtt/kitchen").Value)
+
+	require.NoError(t, waitToken(publisher.Publish("zigbee2mqtt/bathroom", 0, false, `{"humidity": 70}`)))
+
+	assert.Equal(t, tm.Float(70), waitTelemetry(t, storage, "/home/zigbee2mqtt/bathroom").Value)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
@@ -0,0 +1,210 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+// serveFakeMQTT is the minimal MQTT server, which acknowledges connections
+// and subscriptions, publishing the given messages to every subscriber.
+func serveFakeMQTT(listener net.Listener, messages map[string]string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				packet, err := packets.ReadPacket(conn)
+				if err != nil {
+					return
+				}
+
+				switch packet := packet.(type) {
+				case *packets.ConnectPacket:
+					err = packets.NewControlPacket(packets.Connack).Write(conn)
+				case *packets.SubscribePacket:
+					suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+					suback.MessageID = packet.MessageID
+					suback.ReturnCodes = packet.Qoss
+					err = suback.Write(conn)
+
+					for topic, payload := range messages {
+						if err != nil {
+							break
+						}
+
+						publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+						publish.TopicName = topic
+						publish.Payload = []byte(payload)
+						err = publish.Write(conn)
+					}
+				case *packets.PingreqPacket:
+					err = packets.NewControlPacket(packets.Pingresp).Write(conn)
+				case *packets.DisconnectPacket:
+					return
+				}
+
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func waitTelemetry(t *testing.T, storage *tm.TelemetryStorage, topic string) *tm.Telemetry {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		telemetries := storage.Read(topic)
+		if len(telemetries) > 0 {
+			return telemetries[0]
+		}
+
+		require.True(t, time.Now().Before(deadline), "no telemetry for %s", topic)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMQTTSubscriptionTopic(t *testing.T) {
+	assert.Equal(t, "/sensors/kitchen/temp", (&MQTTSubscription{}).Topic("sensors/kitchen/temp"))
+	assert.Equal(t, "/home/sensors/kitchen/temp", (&MQTTSubscription{Prefix: "/home"}).Topic("sensors/kitchen/temp"))
+	assert.Equal(t, "/home/sensors/kitchen/temp", (&MQTTSubscription{Prefix: "/home/"}).Topic("/sensors/kitchen/temp"))
+}
+
+func TestMQTTSubscriptionDecodePlain(t *testing.T) {
+	subscription := &MQTTSubscription{Prefix: "/home"}
+
+	tests := []struct {
+		payload string
+		value   tm.TelemetryValue
+	}{
+		{"21.5", tm.Float(21.5)},
+		{" 21.5\n", tm.Float(21.5)},
+		{"42i", tm.Int(42)},
+		{"true", tm.Bool(true)},
+		{`"heat"`, tm.String("heat")},
+	}
+
+	for _, test := range tests {
+		telemetry, err := subscription.Decode("kitchen/temp", []byte(test.payload))
+		require.NoError(t, err, test.payload)
+		assert.Equal(t, "/home/kitchen/temp", telemetry.Topic)
+		assert.Equal(t, test.value, telemetry.Value, test.payload)
+	}
+
+	_, err := subscription.Decode("kitchen/temp", []byte("warm"))
+	assert.Error(t, err)
+}
+
+func TestMQTTSubscriptionDecodeJSON(t *testing.T) {
+	payload := []byte(`{"state": {"temperature": 21, "humidity": 40.5, "occupied": true, "mode": "heat", "list": [1]}}`)
+
+	tests := []struct {
+		field string
+		value tm.TelemetryValue
+	}{
+		{"state.temperature", tm.Float(21)},
+		{"state.humidity", tm.Float(40.5)},
+		{"state.occupied", tm.Bool(true)},
+		{"state.mode", tm.String("heat")},
+	}
+
+	for _, test := range tests {
+		subscription := &MQTTSubscription{Field: test.field}
+
+		telemetry, err := subscription.Decode("zigbee2mqtt/kitchen", payload)
+		require.NoError(t, err, test.field)
+		assert.Equal(t, "/zigbee2mqtt/kitchen", telemetry.Topic)
+		assert.Equal(t, test.value, telemetry.Value, test.field)
+	}
+
+	for _, field := range []string{"state", "state.list", "state.missing", "state.mode.value"} {
+		_, err := (&MQTTSubscription{Field: field}).Decode("zigbee2mqtt/kitchen", payload)
+		assert.Error(t, err, field)
+	}
+
+	_, err := (&MQTTSubscription{Field: "state"}).Decode("zigbee2mqtt/kitchen", []byte("{"))
+	assert.Error(t, err)
+}
+
+func TestMQTTBrokerRun(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go serveFakeMQTT(listener, map[string]string{
+		"zigbee2mqtt/kitchen": `{"humidity": 40}`,
+	})
+
+	storage := tm.NewTelemetryStorage()
+	broker := NewMQTTBroker(&MQTTConfig{
+		Addr:     "tcp://" + listener.Addr().String(),
+		ClientID: "homekit",
+		Subscriptions: []*MQTTSubscription{
+			{Filter: "zigbee2mqtt/+", Prefix: "/home", Field: "humidity"},
+		},
+	}, zap.NewNop().Sugar())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- broker.Run(ctx, storage)
+	}()
+
+	assert.Equal(t, tm.Float(40), waitTelemetry(t, storage, "/home/zigbee2mqtt/kitchen").Value)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestMQTTBrokerReconnects(t *testing.T) {
+	// Reserve an address and release it, so that the first connection
+	// attempts fail.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	storage := tm.NewTelemetryStorage()
+	broker := NewMQTTBroker(&MQTTConfig{
+		Addr:       "tcp://" + addr,
+		ClientID:   "homekit",
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Subscriptions: []*MQTTSubscription{
+			{Filter: "sensors/#"},
+		},
+	}, zap.NewNop().Sugar())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- broker.Run(ctx, storage)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	listener, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go serveFakeMQTT(listener, map[string]string{"sensors/temp": "21.5"})
+
+	assert.Equal(t, tm.Float(21.5), waitTelemetry(t, storage, "/sensors/temp").Value)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
@@ -0,0 +1,409 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	DefaultStatsDFlushInterval = 10 * time.Second
+
+	statsdMaxDatagramSize = 64 * 1024
+)
+
+// StatsDConfig describes the StatsD listener.
+type StatsDConfig struct {
+	// Addr is the UDP listen address, like ":8125".
+	Addr string
+	// Prefix is prepended to topics, i.e. "home.kitchen.temp" with
+	// "/statsd" prefix becomes "/statsd/home/kitchen/temp".
+	Prefix string
+	// FlushInterval is the interval metrics are aggregated over.
+	//
+	// Defaults to 10s.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// Percentiles of timers to publish, like [90, 99.9].
+	//
+	// Defaults to [90].
+	Percentiles []float64
+}
+
+func (m *StatsDConfig) Validate() error {
+	if len(m.Addr) == 0 {
+		return fmt.Errorf("address is required for StatsD listener")
+	}
+
+	if m.FlushInterval < 0 {
+		return fmt.Errorf("negative StatsD flush interval: %s", m.FlushInterval)
+	}
+
+	for _, percentile := range m.Percentiles {
+		if percentile <= 0 || percentile > 100 {
+			return fmt.Errorf("StatsD percentile must be within (0, 100]: %v", percentile)
+		}
+	}
+
+	return nil
+}
+
+func (m *StatsDConfig) flushInterval() time.Duration {
+	if m.FlushInterval == 0 {
+		return DefaultStatsDFlushInterval
+	}
+
+	return m.FlushInterval
+}
+
+func (m *StatsDConfig) percentiles() []float64 {
+	if len(m.Percentiles) == 0 {
+		return []float64{90}
+	}
+
+	return m.Percentiles
+}
+
+type statsdSeries struct {
+	topic  tm.Topic
+	labels tm.Labels
+}
+
+func (m *statsdSeries) telemetry(suffix string, value tm.TelemetryValue, now time.Time) *tm.Telemetry {
+	return &tm.Telemetry{
+		Topic:     m.topic + suffix,
+		Value:     value,
+		Labels:    m.labels,
+		Timestamp: now,
+	}
+}
+
+type statsdCounter struct {
+	statsdSeries
+	value float64
+}
+
+type statsdGauge struct {
+	statsdSeries
+	value float64
+}
+
+type statsdTimer struct {
+	statsdSeries
+	// Count is scaled according to the sample rate, hence may differ
+	// from the number of samples.
+	count   float64
+	samples []float64
+}
+
+type statsdSet struct {
+	statsdSeries
+	values map[string]struct{}
+}
+
+// statsdAggregator aggregates StatsD metrics, i.e.
+// "<name>:<value>|<type>[|@<rate>][|#<tag>:<value>,...]", over flush
+// intervals.
+//
+// Flushing follows the reference StatsD implementation with deleteCounters
+// enabled:
+//   - counters ("c") publish the sum over the interval as "<topic>" and the
+//     per-second rate as "<topic>_rate", and reset, so idle counters are
+//     not published;
+//   - gauges ("g") publish the last value and keep it, values with a sign
+//     modify the current value;
+//   - timers ("ms", "h" and "d") publish "<topic>_count", "_min", "_max",
+//     "_mean" and "_p<percentile>" and reset;
+//   - sets ("s") publish the number of unique values and reset.
+type statsdAggregator struct {
+	prefix      string
+	percentiles []float64
+
+	mu       sync.Mutex
+	counters map[string]*statsdCounter
+	gauges   map[string]*statsdGauge
+	timers   map[string]*statsdTimer
+	sets     map[string]*statsdSet
+}
+
+func newStatsDAggregator(cfg *StatsDConfig) *statsdAggregator {
+	return &statsdAggregator{
+		prefix:      cfg.Prefix,
+		percentiles: cfg.percentiles(),
+		counters:    map[string]*statsdCounter{},
+		gauges:      map[string]*statsdGauge{},
+		timers:      map[string]*statsdTimer{},
+		sets:        map[string]*statsdSet{},
+	}
+}
+
+func (m *statsdAggregator) Add(line string) error {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return fmt.Errorf("expected \"<name>:<value>|<type>\", got %q", line)
+	}
+
+	topic, err := dottedTopic(m.prefix, line[:colon])
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return fmt.Errorf("missing type of %s", topic)
+	}
+
+	value, kind := parts[0], parts[1]
+
+	rate := 1.0
+	var labels tm.Labels
+	for _, extension := range parts[2:] {
+		switch {
+		case strings.HasPrefix(extension, "@"):
+			rate, err = strconv.ParseFloat(extension[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return fmt.Errorf("invalid sample rate of %s: %s", topic, extension)
+			}
+		case strings.HasPrefix(extension, "#"):
+			labels = parseStatsDTags(extension[1:])
+		default:
+			return fmt.Errorf("unknown extension of %s: %s", topic, extension)
+		}
+	}
+
+	series := statsdSeries{topic: topic, labels: labels}
+	key := topic + labels.String()
+
+	if kind == "s" {
+		m.mu.Lock()
+		set, ok := m.sets[key]
+		if !ok {
+			set = &statsdSet{statsdSeries: series, values: map[string]struct{}{}}
+			m.sets[key] = set
+		}
+		set.values[value] = struct{}{}
+		m.mu.Unlock()
+
+		return nil
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value of %s: %v", topic, err)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("non-finite value of %s: %s", topic, value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch kind {
+	case "c":
+		counter, ok := m.counters[key]
+		if !ok {
+			counter = &statsdCounter{statsdSeries: series}
+			m.counters[key] = counter
+		}
+		counter.value += v / rate
+	case "g":
+		gauge, ok := m.gauges[key]
+		if !ok {
+			gauge = &statsdGauge{statsdSeries: series}
+			m.gauges[key] = gauge
+		}
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			gauge.value += v
+		} else {
+			gauge.value = v
+		}
+	case "ms", "h", "d":
+		timer, ok := m.timers[key]
+		if !ok {
+			timer = &statsdTimer{statsdSeries: series}
+			m.timers[key] = timer
+		}
+		timer.count += 1 / rate
+		timer.samples = append(timer.samples, v)
+	default:
+		return fmt.Errorf("unknown type of %s: %s", topic, kind)
+	}
+
+	return nil
+}
+
+func parseStatsDTags(v string) tm.Labels {
+	labels := tm.Labels{}
+	for _, tag := range strings.Split(v, ",") {
+		kv := strings.SplitN(tag, ":", 2)
+		// Value-less tags have nothing to map to.
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			continue
+		}
+
+		labels[kv[0]] = kv[1]
+	}
+
+	if len(labels) == 0 {
+		return nil
+	}
+
+	return labels
+}
+
+// Flush returns metrics aggregated since the last flush, which happened
+// the given interval ago, and resets them.
+func (m *statsdAggregator) Flush(now time.Time, interval time.Duration) []*tm.Telemetry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tmVec []*tm.Telemetry
+
+	// Deleting counters keeps arbitrary metric names from piling up.
+	for key, counter := range m.counters {
+		tmVec = append(tmVec,
+			counter.telemetry("", tm.Float(counter.value), now),
+			counter.telemetry("_rate", tm.Float(counter.value/interval.Seconds()), now),
+		)
+		delete(m.counters, key)
+	}
+
+	for _, gauge := range m.gauges {
+		tmVec = append(tmVec, gauge.telemetry("", tm.Float(gauge.value), now))
+	}
+
+	for key, timer := range m.timers {
+		sort.Float64s(timer.samples)
+
+		sum := 0.0
+		for _, sample := range timer.samples {
+			sum += sample
+		}
+
+		tmVec = append(tmVec,
+			timer.telemetry("_count", tm.Float(timer.count), now),
+			timer.telemetry("_min", tm.Float(timer.samples[0]), now),
+			timer.telemetry("_max", tm.Float(timer.samples[len(timer.samples)-1]), now),
+			timer.telemetry("_mean", tm.Float(sum/float64(len(timer.samples))), now),
+		)
+
+		for _, percentile := range m.percentiles {
+			suffix := "_p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+			tmVec = append(tmVec, timer.telemetry(suffix, tm.Float(nearestRank(timer.samples, percentile)), now))
+		}
+
+		delete(m.timers, key)
+	}
+
+	for key, set := range m.sets {
+		tmVec = append(tmVec, set.telemetry("", tm.Float(float64(len(set.values))), now))
+		delete(m.sets, key)
+	}
+
+	return tmVec
+}
+
+// nearestRank returns the percentile of sorted samples using the
+// nearest-rank method.
+func nearestRank(samples []float64, percentile float64) float64 {
+	rank := int(math.Ceil(percentile / 100 * float64(len(samples))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return samples[rank-1]
+}
+
+// statsdBroker accepts StatsD metrics via UDP, aggregates them and puts
+// into the storage every flush interval.
+type statsdBroker struct {
+	cfg *StatsDConfig
+	log *zap.SugaredLogger
+}
+
+func NewStatsDBroker(cfg *StatsDConfig, log *zap.SugaredLogger) *statsdBroker {
+	return &statsdBroker{
+		cfg: cfg,
+		log: log,
+	}
+}
+
+func (m *statsdBroker) Run(ctx context.Context, storage *tm.TelemetryStorage) error {
+	if err := m.cfg.Validate(); err != nil {
+		return err
+	}
+
+	sock, err := net.ListenPacket("udp", m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	aggregator := newStatsDAggregator(m.cfg)
+
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		return m.run(ctx, sock, aggregator)
+	})
+	wg.Go(func() error {
+		return m.flush(ctx, aggregator, storage)
+	})
+
+	<-ctx.Done()
+	if err := sock.Close(); err != nil {
+		m.log.Warnf("failed to close UDP socket: %v", err)
+	}
+
+	return wg.Wait()
+}
+
+// This function MUST never finish with "nil" error.
+func (m *statsdBroker) run(ctx context.Context, sock net.PacketConn, aggregator *statsdAggregator) error {
+	buf := make([]byte, statsdMaxDatagramSize)
+	for {
+		nRead, remoteAddr, err := sock.ReadFrom(buf[:])
+		if err != nil {
+			return err
+		}
+
+		m.log.Debugf("received %d bytes from %s", nRead, remoteAddr)
+
+		for _, line := range strings.Split(string(buf[:nRead]), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+
+			if err := aggregator.Add(line); err != nil {
+				m.log.Warnf("failed to parse StatsD metric from %s: %v", remoteAddr, err)
+			}
+		}
+	}
+}
+
+func (m *statsdBroker) flush(ctx context.Context, aggregator *statsdAggregator, storage *tm.TelemetryStorage) error {
+	interval := m.cfg.flushInterval()
+
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-timer.C:
+			if values := aggregator.Flush(now, interval); len(values) > 0 {
+				storage.PutMulti(values)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+func flushStatsD(aggregator *statsdAggregator, interval time.Duration) map[string]tm.TelemetryValue {
+	values := map[string]tm.TelemetryValue{}
+	for _, telemetry := range aggregator.Flush(time.Now(), interval) {
+		values[telemetry.Key()] = telemetry.Value
+	}
+
+	return values
+}
+
+func TestStatsDCounter(t *testing.T) {
+	aggregator := newStatsDAggregator(&StatsDConfig{})
+
+	require.NoError(t, aggregator.Add("home.door.opened:1|c"))
+	require.NoError(t, aggregator.Add("home.door.opened:2|c"))
+	require.NoError(t, aggregator.Add("home.door.opened:1|c|@0.5"))
+
+	values := flushStatsD(aggregator, 10*time.Second)
+	assert.Equal(t, tm.Float(5), values["/home/door/opened"])
+	assert.Equal(t, tm.Float(0.5), values["/home/door/opened_rate"])
+
+	// Counters without increments are not published.
+	assert.Empty(t, flushStatsD(aggregator, 10*time.Second))
+	assert.Empty(t, aggregator.counters)
+}
+
+func TestStatsDGauge(t *testing.T) {
+	aggregator := newStatsDAggregator(&StatsDConfig{Prefix: "/statsd"})
+
+	require.NoError(t, aggregator.Add("home.temp:21|g"))
+	require.NoError(t, aggregator.Add("home.temp:+2|g"))
+	require.NoError(t, aggregator.Add("home.temp:-0.5|g"))
+
+	values := flushStatsD(aggregator, 10*time.Second)
+	assert.Equal(t, tm.Float(22.5), values["/statsd/home/temp"])
+
+	// Gauges keep their values between flushes.
+	values = flushStatsD(aggregator, 10*time.Second)
+	assert.Equal(t, tm.Float(22.5), values["/statsd/home/temp"])
+}
+
+func TestStatsDTimer(t *testing.T) {
+	aggregator := newStatsDAggregator(&StatsDConfig{Percentiles: []float64{50, 99.9}})
+
+	for _, line := range []string{"req:40|ms", "req:10|ms", "req:30|ms", "req:20|ms|@0.5"} {
+		require.NoError(t, aggregator.Add(line))
+	}
+
+	values := flushStatsD(aggregator, 10*time.Second)
+	assert.Equal(t, tm.Float(5), values["/req_count"])
+	assert.Equal(t, tm.Float(10), values["/req_min"])
+	assert.Equal(t, tm.Float(40), values["/req_max"])
+	assert.Equal(t, tm.Float(25), values["/req_mean"])
+	assert.Equal(t, tm.Float(20), values["/req_p50"])
+	assert.Equal(t, tm.Float(40), values["/req_p99_9"])
+
+	// Timers without samples are not published.
+	assert.Empty(t, flushStatsD(aggregator, 10*time.Second))
+}
+
+func TestStatsDSet(t *testing.T) {
+	aggregator := newStatsDAggregator(&StatsDConfig{})
+
+	for _, line := range []string{"users:alice|s", "users:bob|s", "users:alice|s"} {
+		require.NoError(t, aggregator.Add(line))
+	}
+
+	values := flushStatsD(aggregator, 10*time.Second)
+	assert.Equal(t, tm.Float(2), values["/users"])
+}
+
+func TestStatsDTags(t *testing.T) {
+	aggregator := newStatsDAggregator(&StatsDConfig{})
+
+	require.NoError(t, aggregator.Add("temp:21|g|#room:kitchen,debug"))
+
+	values := flushStatsD(aggregator, 10*time.Second)
+	assert.Equal(t, tm.Float(21), values["/temp{room=kitchen}"])
+}
+
+func TestStatsDInvalid(t *testing.T) {
+	aggregator := newStatsDAggregator(&StatsDConfig{})
+
+	for _, line := range []string{
+		"temp",
+		"temp:21",
+		"temp:hot|g",
+		"temp:21|x",
+		"temp:1|c|@2",
+		"temp:1|c|?",
+		":1|c",
+		"home.+.temp:1|g",
+		"temp:NaN|g",
+		"temp:+Inf|g",
+		"req:-Inf|ms",
+	} {
+		assert.Error(t, aggregator.Add(line), line)
+	}
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+)
+
+// SkewPolicy describes what happens with a sensor-supplied timestamp that
+// is outside of the allowed skew window.
+type SkewPolicy string
+
+const (
+	// SkewFallback replaces the timestamp with the receive time.
+	SkewFallback SkewPolicy = "fallback"
+	// SkewReject rejects the telemetry.
+	SkewReject SkewPolicy = "reject"
+)
+
+// TimestampConfig describes how sensor-supplied timestamps are treated.
+//
+// By default they are ignored and the receive time is used instead.
+type TimestampConfig struct {
+	// MaxSkew is the maximum difference between the sensor-supplied
+	// timestamp and the receive time, in both directions.
+	//
+	// Zero disables sensor-supplied timestamps.
+	MaxSkew time.Duration `yaml:"max_skew"`
+	// OnSkew is the policy for timestamps outside of the skew window.
+	//
+	// Defaults to "fallback".
+	OnSkew SkewPolicy `yaml:"on_skew"`
+}
+
+func (m *TimestampConfig) Validate() error {
+	switch m.OnSkew {
+	case SkewFallback, SkewReject, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown skew policy: %s", m.OnSkew)
+	}
+}
+
+func (m *TimestampConfig) resolve(timestamp, now time.Time) (time.Time, error) {
+	if m == nil || m.MaxSkew <= 0 {
+		return now, nil
+	}
+
+	skew := now.Sub(timestamp)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew <= m.MaxSkew {
+		return timestamp, nil
+	}
+
+	switch m.OnSkew {
+	case SkewReject:
+		return time.Time{}, fmt.Errorf("timestamp %d is %s away from the receive time", timestamp.Unix(), skew)
+	case SkewFallback, "":
+		return now, nil
+	default:
+		return time.Time{}, fmt.Errorf("unknown skew policy: %s", m.OnSkew)
+	}
+}
@@ -4,70 +4,143 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
+	"homekit-ng/homekit/metrics"
 	"homekit-ng/homekit/tm"
 )
 
-// Decoder decodes the UDP packet into telemetry values.
-//
-// The format is: "<topic>=<value>";
-type decoder struct{}
+type UDPConfig struct {
+	// Addr is the listen address, like ":9090", "192.168.1.2:9090" or
+	// "[::1]:9090". Takes precedence over Port.
+	Addr string
+	// Port to listen on all addresses, both IPv4 and IPv6.
+	Port uint16
+	// Format of datagrams, see Format. Defaults to "auto".
+	Format Format
+	// TopicIDs map integer ids of the CBOR format to topics with optional
+	// labels, like "/home/temp{room=kitchen}".
+	TopicIDs   map[uint64]string `yaml:"topic_ids"`
+	Timestamps TimestampConfig
+	Auth       UDPAuthConfig
+	// Sources restrict topics each source is allowed to write, see
+	// UDPSourceConfig.
+	Sources []*UDPSourceConfig
+	Limits  UDPLimitsConfig
+	// Replies enable delivery acknowledgements, see UDPReplyMode.
+	Replies UDPReplyMode
+}
 
-func (m *decoder) Decode(v string) ([]*tm.Telemetry, error) {
-	var tmVec []*tm.Telemetry
-	for _, kv := range strings.Split(v, ";") {
-		kv = strings.TrimSpace(kv)
+func (m *UDPConfig) Validate() error {
+	if _, err := NewDecoder(m.Format, &m.Timestamps, m.TopicIDs); err != nil {
+		return err
+	}
 
-		if len(kv) == 0 {
-			continue
-		}
+	if err := m.Timestamps.Validate(); err != nil {
+		return err
+	}
 
-		parts := strings.Split(kv, "=")
+	if err := m.Auth.Validate(); err != nil {
+		return err
+	}
 
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid telemetry key-value pair: %s", kv)
-		}
+	if err := m.Limits.Validate(); err != nil {
+		return err
+	}
 
-		topic := parts[0]
-		value, err := strconv.ParseFloat(parts[1], 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid telemetry value: %v", err)
-		}
+	if err := m.Replies.Validate(); err != nil {
+		return err
+	}
 
-		tmVec = append(tmVec, tm.NewTelemetry(topic, value))
+	_, err := newSourceACL(m.Sources)
+	return err
+}
+
+func (m *UDPConfig) addr() string {
+	if len(m.Addr) != 0 {
+		return m.Addr
 	}
 
-	return tmVec, nil
+	return fmt.Sprintf(":%d", m.Port)
+}
+
+// udpMaxDatagramSize is the maximum size of the UDP payload.
+const udpMaxDatagramSize = 65535
+
+type udpMetrics struct {
+	datagrams      *metrics.Counter
+	bytes          *metrics.Counter
+	authFailures   *metrics.Counter
+	decodeFailures *metrics.Counter
+	denied         *metrics.Counter
+	accepted       *metrics.Counter
+	acks           *metrics.Counter
+	nacks          *metrics.Counter
+}
+
+func newUDPMetrics(registry *metrics.Registry, addr string) *udpMetrics {
+	labels := tm.Labels{"addr": addr}
+
+	return &udpMetrics{
+		datagrams:      registry.Counter("udp/datagrams", labels),
+		bytes:          registry.Counter("udp/bytes", labels),
+		authFailures:   registry.Counter("udp/auth_failures", labels),
+		decodeFailures: registry.Counter("udp/decode_failures", labels),
+		denied:         registry.Counter("udp/denied", labels),
+		accepted:       registry.Counter("udp/accepted", labels),
+		acks:           registry.Counter("udp/acks", labels),
+		nacks:          registry.Counter("udp/nacks", labels),
+	}
 }
 
 type udpBroker struct {
-	port uint16
-	log  *zap.SugaredLogger
+	cfg      *UDPConfig
+	registry *metrics.Registry
+	metrics  *udpMetrics
+	log      *zap.SugaredLogger
+}
+
+func NewUDPBroker(cfg *UDPConfig, log *zap.SugaredLogger) *udpBroker {
+	return newUDPBroker(cfg, metrics.Default, log)
 }
 
-func NewUDPBroker(port uint16, log *zap.SugaredLogger) *udpBroker {
+// newUDPBroker constructs the broker reporting all of its counters, including
+// the limiter ones, into the given registry.
+func newUDPBroker(cfg *UDPConfig, registry *metrics.Registry, log *zap.SugaredLogger) *udpBroker {
 	return &udpBroker{
-		port: port,
-		log:  log,
+		cfg:      cfg,
+		registry: registry,
+		metrics:  newUDPMetrics(registry, cfg.addr()),
+		log:      log,
 	}
 }
 
 func (m *udpBroker) Run(ctx context.Context, tm *tm.TelemetryStorage) error {
-	addr := fmt.Sprintf("0.0.0.0:%d", m.port)
+	if err := m.cfg.Validate(); err != nil {
+		return err
+	}
 
-	sock, err := net.ListenPacket("udp", addr)
+	acl, err := newSourceACL(m.cfg.Sources)
+	if err != nil {
+		return err
+	}
+
+	decoder, err := NewDecoder(m.cfg.Format, &m.cfg.Timestamps, m.cfg.TopicIDs)
+	if err != nil {
+		return err
+	}
+
+	sock, err := net.ListenPacket("udp", m.cfg.addr())
 	if err != nil {
 		return err
 	}
 
 	wg, ctx := errgroup.WithContext(ctx)
 	wg.Go(func() error {
-		return m.run(ctx, sock, tm)
+		return m.run(ctx, sock, decoder, acl, tm)
 	})
 
 	<-ctx.Done()
@@ -78,10 +151,25 @@ func (m *udpBroker) Run(ctx context.Context, tm *tm.TelemetryStorage) error {
 	return wg.Wait()
 }
 
+// udpPipeline holds the state of datagram processing of a single socket.
+type udpPipeline struct {
+	decoder Decoder
+	auth    *authenticator
+	acl     *sourceACL
+	limiter *limiter
+}
+
 // This function MUST never finish with "nil" error.
-func (m *udpBroker) run(ctx context.Context, sock net.PacketConn, tm *tm.TelemetryStorage) error {
-	buf := make([]byte, 4096)
-	decoder := &decoder{}
+func (m *udpBroker) run(ctx context.Context, sock net.PacketConn, decoder Decoder, acl *sourceACL, tm *tm.TelemetryStorage) error {
+	// The buffer fits any UDP payload, since a truncated JSON document or
+	// NDJSON line would otherwise be rejected or, worse, partially applied.
+	buf := make([]byte, udpMaxDatagramSize)
+	pipeline := &udpPipeline{
+		decoder: decoder,
+		auth:    newAuthenticator(&m.cfg.Auth),
+		acl:     acl,
+		limiter: newLimiter(&m.cfg.Limits, m.registry, m.cfg.addr(), m.log),
+	}
 
 	for {
 		nRead, remoteAddr, err := sock.ReadFrom(buf[:])
@@ -90,13 +178,117 @@ func (m *udpBroker) run(ctx context.Context, sock net.PacketConn, tm *tm.Telemet
 		}
 
 		m.log.Debugf("received %d bytes from %s", nRead, remoteAddr)
+		m.metrics.datagrams.Inc()
+		m.metrics.bytes.Add(uint64(nRead))
 
-		values, err := decoder.Decode(string(buf[:nRead]))
-		if err != nil {
-			m.log.Warnf("failed to parse datagram: %v", err)
+		now := time.Now()
+		if !pipeline.limiter.AllowDatagram(sourceIP(remoteAddr), now) {
+			continue
+		}
+
+		reply := m.handle(pipeline, buf[:nRead], remoteAddr, now, tm)
+		if !m.cfg.Replies.answers(reply) {
+			continue
+		}
+
+		if _, err := sock.WriteTo(reply.Bytes(), remoteAddr); err != nil {
+			m.log.Debugf("failed to reply to %s: %v", remoteAddr, err)
 			continue
 		}
 
+		if len(reply.Code) == 0 {
+			m.metrics.acks.Inc()
+		} else {
+			m.metrics.nacks.Inc()
+		}
+	}
+}
+
+// handle puts telemetry values of the datagram into the storage, returning
+// the reply describing the outcome.
+func (m *udpBroker) handle(pipeline *udpPipeline, datagram []byte, remoteAddr net.Addr, now time.Time, tm *tm.TelemetryStorage) *udpReply {
+	source := sourceIP(remoteAddr)
+
+	payload, sensor, err := pipeline.auth.Authenticate(datagram)
+	if err != nil {
+		m.log.Warnf("rejected datagram from %s: %v", remoteAddr, err)
+		m.metrics.authFailures.Inc()
+		return &udpReply{Code: replyAuth}
+	}
+
+	if len(sensor) != 0 {
+		m.log.Debugf("authenticated datagram from %s as sensor %s", remoteAddr, sensor)
+	}
+
+	payload, seq, hasSeq, err := splitSequence(payload)
+	if err != nil {
+		m.log.Warnf("failed to parse datagram from %s: %v", remoteAddr, err)
+		m.metrics.decodeFailures.Inc()
+		return &udpReply{Code: replyMalformed}
+	}
+
+	reply := &udpReply{
+		Seq:    seq,
+		HasSeq: hasSeq,
+	}
+
+	values, pairErrs, err := pipeline.decoder.Decode(payload, now)
+	if err != nil {
+		m.log.Warnf("failed to parse datagram from %s: %v", remoteAddr, err)
+		m.metrics.decodeFailures.Inc()
+		reply.Fail(replyMalformed)
+		return reply
+	}
+
+	for _, err := range pairErrs {
+		m.log.Warnf("rejected pair %d %q from %s: %v", err.Index, err.Raw, remoteAddr, err.Err)
+	}
+	m.metrics.decodeFailures.Add(uint64(len(pairErrs)))
+
+	if len(pairErrs) > 0 {
+		reply.Fail(replyInvalid)
+	}
+
+	if len(values) == 0 {
+		return reply
+	}
+
+	if !pipeline.limiter.AllowPairs(source, len(values)+len(pairErrs), now) {
+		reply.Fail(replyTooManyPairs)
+		return reply
+	}
+
+	values, errs := pipeline.acl.Filter(remoteAddr, sensor, values)
+	for _, err := range errs {
+		m.log.Warnf("rejected telemetry from %s: %v", remoteAddr, err)
+	}
+	m.metrics.denied.Add(uint64(len(errs)))
+
+	if len(errs) > 0 {
+		reply.Fail(replyDenied)
+	}
+
+	allowed := len(values)
+	values = pipeline.limiter.AllowTopics(source, values, now)
+	if len(values) < allowed {
+		reply.Fail(replyTooManyTopics)
+	}
+
+	if len(values) > 0 {
 		tm.PutMulti(values)
+		m.metrics.accepted.Add(uint64(len(values)))
 	}
+	reply.Accepted = len(values)
+
+	return reply
+}
+
+// sourceIP returns the IP address of the datagram source, ignoring the
+// port, which usually changes from datagram to datagram.
+func sourceIP(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+
+	return addr.String()
 }
@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UDPAuthMagic starts the header of authenticated datagrams.
+const UDPAuthMagic = "HK1"
+
+// udpAuthMillisThreshold separates timestamp counters in Unix seconds from
+// the ones in milliseconds, since seconds reach it only in year 5138.
+const udpAuthMillisThreshold = 100000000000
+
+// UDPAuthConfig describes authentication of UDP datagrams.
+//
+// Authenticated datagrams start with the header line, followed by the
+// usual payload:
+//
+//	HK1 <sensor-id> <counter> <hmac>
+//	/home/temp=21.5;/home/humidity=40
+//
+// where <hmac> is the hex-encoded HMAC-SHA256 with the sensor key over
+// everything except the " <hmac>" part, i.e. over
+// "HK1 <sensor-id> <counter>\n<payload>".
+//
+// The counter must strictly increase for each sensor, which protects
+// against replays. It can be either a sequence number or a Unix timestamp.
+// Since the last seen counters are not persisted, a timestamp with MaxAge
+// configured is the way to survive restarts. Sensors sending more than one
+// datagram per second should use timestamps in milliseconds.
+type UDPAuthConfig struct {
+	// Keys maps sensor ids to their secret keys.
+	Keys map[string]string
+	// Required rejects plain datagrams. Otherwise both plain and
+	// authenticated datagrams are accepted, which allows migrating sensors
+	// one by one.
+	Required bool
+	// MaxAge, when set, treats counters as Unix timestamps and rejects
+	// datagrams older than this, or that far in the future. Counters of
+	// 10^11 and above are milliseconds, the ones below are seconds.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (m *UDPAuthConfig) Validate() error {
+	if m.Required && len(m.Keys) == 0 {
+		return fmt.Errorf("UDP authentication is required, but no keys are configured")
+	}
+
+	for sensor, key := range m.Keys {
+		if len(sensor) == 0 || strings.ContainsAny(sensor, " \n") {
+			return fmt.Errorf("invalid sensor id: %q", sensor)
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("empty key of sensor %s", sensor)
+		}
+	}
+
+	return nil
+}
+
+// authenticator verifies datagrams according to the UDPAuthConfig.
+//
+// It is not safe for concurrent use.
+type authenticator struct {
+	cfg *UDPAuthConfig
+	// counters keeps the last accepted counter of each sensor.
+	counters map[string]uint64
+	// Now returns the receive time, overridden in tests.
+	Now func() time.Time
+}
+
+func newAuthenticator(cfg *UDPAuthConfig) *authenticator {
+	return &authenticator{
+		cfg:      cfg,
+		counters: map[string]uint64{},
+		Now:      time.Now,
+	}
+}
+
+// Authenticate verifies the datagram, returning its payload and the sensor
+// id, which is empty for plain datagrams.
+func (m *authenticator) Authenticate(datagram []byte) ([]byte, string, error) {
+	if !bytes.HasPrefix(datagram, []byte(UDPAuthMagic+" ")) {
+		if m.cfg.Required {
+			return nil, "", fmt.Errorf("unauthenticated datagram")
+		}
+		return datagram, "", nil
+	}
+
+	newline := bytes.IndexByte(datagram, '\n')
+	if newline < 0 {
+		return nil, "", fmt.Errorf("missing payload after authentication header")
+	}
+
+	header := strings.Split(string(datagram[:newline]), " ")
+	if len(header) != 4 {
+		return nil, "", fmt.Errorf("malformed authentication header")
+	}
+
+	sensor, counterText, mac := header[1], header[2], header[3]
+
+	key, ok := m.cfg.Keys[sensor]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown sensor %s", sensor)
+	}
+
+	counter, err := strconv.ParseUint(counterText, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid counter of sensor %s: %v", sensor, err)
+	}
+
+	expectedMAC, err := hex.DecodeString(mac)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid HMAC encoding of sensor %s: %v", sensor, err)
+	}
+
+	signed := strings.Join(header[:3], " ")
+	payload := datagram[newline+1:]
+	if !hmac.Equal(expectedMAC, udpMAC(key, signed, payload)) {
+		return nil, "", fmt.Errorf("HMAC mismatch of sensor %s", sensor)
+	}
+
+	if last, ok := m.counters[sensor]; ok && counter <= last {
+		return nil, "", fmt.Errorf("replayed counter %d of sensor %s, last is %d", counter, sensor, last)
+	}
+
+	if m.cfg.MaxAge > 0 {
+		age := m.Now().Sub(counterTime(counter))
+		if age > m.cfg.MaxAge || age < -m.cfg.MaxAge {
+			return nil, "", fmt.Errorf("counter %d of sensor %s is %s away from the receive time", counter, sensor, age)
+		}
+	}
+
+	m.counters[sensor] = counter
+
+	return payload, sensor, nil
+}
+
+// counterTime converts the timestamp counter in Unix seconds or
+// milliseconds to time.
+func counterTime(counter uint64) time.Time {
+	if counter < udpAuthMillisThreshold {
+		return time.Unix(int64(counter), 0)
+	}
+
+	return time.Unix(int64(counter/1000), int64(counter%1000)*int64(time.Millisecond))
+}
+
+// udpMAC computes HMAC over the header without the HMAC itself, i.e.
+// "HK1 <sensor-id> <counter>", and the payload.
+func udpMAC(key, header string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(header + "\n"))
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signDatagram(sensor, key string, counter uint64, payload string) []byte {
+	header := fmt.Sprintf("%s %s %d", UDPAuthMagic, sensor, counter)
+	mac := hex.EncodeToString(udpMAC(key, header, []byte(payload)))
+
+	return []byte(header + " " + mac + "\n" + payload)
+}
+
+func TestAuthenticatePlain(t *testing.T) {
+	auth := newAuthenticator(&UDPAuthConfig{Keys: map[string]string{"thermostat": "secret"}})
+
+	payload, sensor, err := auth.Authenticate([]byte("/home/temp=21.5"))
+	require.NoError(t, err)
+	assert.Equal(t, "/home/temp=21.5", string(payload))
+	assert.Empty(t, sensor)
+
+	auth.cfg.Required = true
+	_, _, err = auth.Authenticate([]byte("/home/temp=21.5"))
+	assert.Error(t, err)
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := newAuthenticator(&UDPAuthConfig{Keys: map[string]string{"thermostat": "secret"}, Required: true})
+
+	payload, sensor, err := auth.Authenticate(signDatagram("thermostat", "secret", 1, "/home/temp=21.5"))
+	require.NoError(t, err)
+	assert.Equal(t, "/home/temp=21.5", string(payload))
+	assert.Equal(t, "thermostat", sensor)
+}
+
+func TestAuthenticateRejected(t *testing.T) {
+	auth := newAuthenticator(&UDPAuthConfig{Keys: map[string]string{"thermostat": "secret"}})
+
+	tampered := signDatagram("thermostat", "secret", 1, "/home/temp=21.5")
+	tampered[len(tampered)-1] = '9'
+
+	for name, datagram := range map[string][]byte{
+		"unknown sensor": signDatagram("heater", "secret", 1, "/home/temp=21.5"),
+		"wrong key":      signDatagram("thermostat", "guess", 1, "/home/temp=21.5"),
+		"tampered":       tampered,
+		"no payload":     []byte("HK1 thermostat 1 00"),
+		"malformed":      []byte("HK1 thermostat 1\n/home/temp=21.5"),
+		"bad counter":    []byte("HK1 thermostat x 00\n/home/temp=21.5"),
+		"bad encoding":   []byte("HK1 thermostat 1 zz\n/home/temp=21.5"),
+	} {
+		_, _, err := auth.Authenticate(datagram)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	auth := newAuthenticator(&UDPAuthConfig{Keys: map[string]string{"thermostat": "secret"}})
+
+	datagram := signDatagram("thermostat", "secret", 10, "/home/temp=21.5")
+	_, _, err := auth.Authenticate(datagram)
+	require.NoError(t, err)
+
+	_, _, err = auth.Authenticate(datagram)
+	assert.Error(t, err)
+
+	_, _, err = auth.Authenticate(signDatagram("thermostat", "secret", 9, "/home/temp=21.5"))
+	assert.Error(t, err)
+
+	_, _, err = auth.Authenticate(signDatagram("thermostat", "secret", 11, "/home/temp=21.5"))
+	assert.NoError(t, err)
+}
+
+func TestAuthenticateMaxAge(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	auth := newAuthenticator(&UDPAuthConfig{Keys: map[string]string{"thermostat": "secret"}, MaxAge: time.Minute})
+	auth.Now = func() time.Time { return now }
+
+	_, _, err := auth.Authenticate(signDatagram("thermostat", "secret", 1559990000, "/home/temp=21.5"))
+	assert.Error(t, err)
+
+	_, _, err = auth.Authenticate(signDatagram("thermostat", "secret", 1560090000, "/home/temp=21.5"))
+	assert.Error(t, err)
+
+	_, _, err = auth.Authenticate(signDatagram("thermostat", "secret", 1559999990, "/home/temp=21.5"))
+	assert.NoError(t, err)
+}
+
+func TestAuthenticateMaxAgeMillis(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	auth := newAuthenticator(&UDPAuthConfig{Keys: map[string]string{"thermostat": "secret"}, MaxAge: time.Minute})
+	auth.Now = func() time.Time { return now }
+
+	// Several datagrams within the same second.
+	for _, counter := range []uint64{1559999990100, 1559999990200, 1559999990300} {
+		_, _, err := auth.Authenticate(signDatagram("thermostat", "secret", counter, "/home/temp=21.5"))
+		assert.NoError(t, err, counter)
+	}
+
+	_, _, err := auth.Authenticate(signDatagram("thermostat", "secret", 1560090000000, "/home/temp=21.5"))
+	assert.Error(t, err)
+
+	auth = newAuthenticator(auth.cfg)
+	auth.Now = func() time.Time { return now }
+	_, _, err = auth.Authenticate(signDatagram("thermostat", "secret", 1559990000000, "/home/temp=21.5"))
+	assert.Error(t, err)
+}
+
+func TestUDPAuthConfigValidate(t *testing.T) {
+	assert.NoError(t, (&UDPAuthConfig{}).Validate())
+	assert.Error(t, (&UDPAuthConfig{Required: true}).Validate())
+	assert.Error(t, (&UDPAuthConfig{Keys: map[string]string{"thermostat": ""}}).Validate())
+	assert.Error(t, (&UDPAuthConfig{Keys: map[string]string{"living room": "secret"}}).Validate())
+}
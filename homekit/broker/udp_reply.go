@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// UDPSequenceMagic starts the optional sequence header of datagrams, which
+// is "SEQ <number>\n" followed by the payload. The header goes after the
+// authentication header, if any, so it is covered by the HMAC.
+const UDPSequenceMagic = "SEQ"
+
+// UDPReplyMode describes which datagrams the broker answers with delivery
+// acknowledgements.
+//
+// Replies are sent to the datagram source as "ACK <seq> <accepted>" if all
+// telemetry values were accepted and "NACK <seq> <code> <accepted>"
+// otherwise, where "<seq>" is the sequence number of the datagram or "-"
+// and "<accepted>" is the number of accepted values. See udpReplyCode for
+// error codes.
+//
+// Datagrams dropped by rate limits or bans are never answered, so that
+// flooding sources do not get the broker to flood back.
+type UDPReplyMode string
+
+const (
+	// ReplyNone disables replies.
+	ReplyNone UDPReplyMode = "none"
+	// ReplyAll answers every datagram.
+	ReplyAll UDPReplyMode = "all"
+	// ReplySequenced answers only datagrams carrying sequence numbers.
+	ReplySequenced UDPReplyMode = "sequenced"
+)
+
+func (m UDPReplyMode) Validate() error {
+	switch m {
+	case ReplyNone, ReplyAll, ReplySequenced, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown UDP reply mode: %s", m)
+	}
+}
+
+// answers checks whether the reply should be sent.
+func (m UDPReplyMode) answers(reply *udpReply) bool {
+	switch m {
+	case ReplyAll:
+		return true
+	case ReplySequenced:
+		return reply.HasSeq
+	default:
+		return false
+	}
+}
+
+// udpReplyCode describes why telemetry values of a datagram were rejected.
+type udpReplyCode string
+
+const (
+	// replyAuth means that the datagram failed authentication.
+	replyAuth udpReplyCode = "auth"
+	// replyMalformed means that the datagram is malformed as a whole.
+	replyMalformed udpReplyCode = "malformed"
+	// replyInvalid means that some values failed decoding.
+	replyInvalid udpReplyCode = "invalid"
+	// replyTooManyPairs means that the datagram has too many values.
+	replyTooManyPairs udpReplyCode = "too_many_pairs"
+	// replyDenied means that some topics are not allowed for the source.
+	replyDenied udpReplyCode = "denied"
+	// replyTooManyTopics means that the source has written too many
+	// distinct topics.
+	replyTooManyTopics udpReplyCode = "too_many_topics"
+)
+
+type udpReply struct {
+	Seq    uint64
+	HasSeq bool
+	// Code is empty if all values were accepted.
+	Code     udpReplyCode
+	Accepted int
+}
+
+// Fail records the error code, keeping the first one.
+func (m *udpReply) Fail(code udpReplyCode) {
+	if len(m.Code) == 0 {
+		m.Code = code
+	}
+}
+
+func (m *udpReply) Bytes() []byte {
+	seq := "-"
+	if m.HasSeq {
+		seq = strconv.FormatUint(m.Seq, 10)
+	}
+
+	if len(m.Code) == 0 {
+		return []byte(fmt.Sprintf("ACK %s %d", seq, m.Accepted))
+	}
+
+	return []byte(fmt.Sprintf("NACK %s %s %d", seq, m.Code, m.Accepted))
+}
+
+// splitSequence splits the optional sequence header off the payload.
+func splitSequence(payload []byte) ([]byte, uint64, bool, error) {
+	if !bytes.HasPrefix(payload, []byte(UDPSequenceMagic+" ")) {
+		return payload, 0, false, nil
+	}
+
+	newline := bytes.IndexByte(payload, '\n')
+	if newline < 0 {
+		return nil, 0, false, fmt.Errorf("missing payload after sequence header")
+	}
+
+	seq, err := strconv.ParseUint(string(payload[len(UDPSequenceMagic)+1:newline]), 10, 64)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("invalid sequence number: %v", err)
+	}
+
+	return payload[newline+1:], seq, true, nil
+}
@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+func TestSplitSequence(t *testing.T) {
+	tests := []struct {
+		v       string
+		payload string
+		seq     uint64
+		hasSeq  bool
+		fail    bool
+	}{
+		{"/home/temp=21.5", "/home/temp=21.5", 0, false, false},
+		{"SEQ 42\n/home/temp=21.5", "/home/temp=21.5", 42, true, false},
+		{"SEQ 42\n", "", 42, true, false},
+		{"SEQ 42", "", 0, false, true},
+		{"SEQ -1\n/home/temp=21.5", "", 0, false, true},
+		{"SEQ\n/home/temp=21.5", "SEQ\n/home/temp=21.5", 0, false, false},
+	}
+
+	for _, test := range tests {
+		payload, seq, hasSeq, err := splitSequence([]byte(test.v))
+		if test.fail {
+			assert.Error(t, err, test.v)
+			continue
+		}
+
+		require.NoError(t, err, test.v)
+		assert.Equal(t, test.payload, string(payload), test.v)
+		assert.Equal(t, test.seq, seq, test.v)
+		assert.Equal(t, test.hasSeq, hasSeq, test.v)
+	}
+}
+
+func TestUDPReplyBytes(t *testing.T) {
+	assert.Equal(t, "ACK 7 2", string((&udpReply{Seq: 7, HasSeq: true, Accepted: 2}).Bytes()))
+	assert.Equal(t, "ACK - 0", string((&udpReply{}).Bytes()))
+	assert.Equal(t, "NACK 7 invalid 1", string((&udpReply{Seq: 7, HasSeq: true, Code: replyInvalid, Accepted: 1}).Bytes()))
+	assert.Equal(t, "NACK - auth 0", string((&udpReply{Code: replyAuth}).Bytes()))
+}
+
+func TestUDPReplyMode(t *testing.T) {
+	sequenced := &udpReply{Seq: 1, HasSeq: true}
+	plain := &udpReply{}
+
+	assert.False(t, ReplyNone.answers(sequenced))
+	assert.False(t, UDPReplyMode("").answers(sequenced))
+	assert.True(t, ReplyAll.answers(plain))
+	assert.True(t, ReplySequenced.answers(sequenced))
+	assert.False(t, ReplySequenced.answers(plain))
+
+	assert.Error(t, UDPReplyMode("sometimes").Validate())
+}
+
+func TestUDPReplies(t *testing.T) {
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cfg := &UDPConfig{
+		Addr:    sock.LocalAddr().String(),
+		Replies: ReplySequenced,
+		Sources: []*UDPSourceConfig{
+			{Name: "local", Addrs: []string{"127.0.0.1"}, Topics: []string{"/home/#"}},
+		},
+	}
+	registry := metrics.NewRegistry()
+	broker := newUDPBroker(cfg, registry, zap.NewNop().Sugar())
+
+	decoder, err := NewDecoder(cfg.Format, &cfg.Timestamps, cfg.TopicIDs)
+	require.NoError(t, err)
+	acl, err := newSourceACL(cfg.Sources)
+	require.NoError(t, err)
+
+	storage := tm.NewTelemetryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- broker.run(ctx, sock, decoder, acl, storage)
+	}()
+	defer func() {
+		cancel()
+		sock.Close()
+		<-done
+	}()
+
+	conn, err := net.Dial("udp", sock.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	exchange := func(datagram string) string {
+		_, err := conn.Write([]byte(datagram))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, 512)
+		n, err := conn.Read(buf)
+		require.NoError(t, err, datagram)
+
+		return string(buf[:n])
+	}
+
+	assert.Equal(t, "ACK 1 2", exchange("SEQ 1\n/home/temp=21.5;/home/hum=40"))
+	assert.Equal(t, "NACK 2 invalid 1", exchange("SEQ 2\n/home/temp=21.5;/home/hum=wet"))
+	assert.Equal(t, "NACK 3 denied 1", exchange("SEQ 3\n/home/temp=21.5;/garage/door=true"))
+	assert.Equal(t, "NACK 4 malformed 0", exchange(`SEQ 4`+"\n"+`{"/home/temp": 21.5`))
+
+	// Datagrams without sequence numbers are not answered.
+	_, err = conn.Write([]byte("/home/light=true"))
+	require.NoError(t, err)
+	assert.Equal(t, "ACK 5 0", exchange("SEQ 5\n"))
+
+	assert.Equal(t, tm.Bool(true), waitTelemetry(t, storage, "/home/light").Value)
+	assert.Empty(t, storage.Read("/garage/door"))
+
+	labels := tm.Labels{"addr": cfg.Addr}
+	assert.Equal(t, uint64(6), registry.Counter("udp/datagrams", labels).Value())
+	assert.Equal(t, uint64(2), registry.Counter("udp/acks", labels).Value())
+	assert.Equal(t, uint64(3), registry.Counter("udp/nacks", labels).Value())
+	assert.Equal(t, uint64(0), metrics.Default.Counter("udp/datagrams", labels).Value())
+}
@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+func TestUDPLargeDatagram(t *testing.T) {
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cfg := &UDPConfig{
+		Addr:    sock.LocalAddr().String(),
+		Format:  FormatNDJSON,
+		Replies: ReplyAll,
+	}
+	broker := newUDPBroker(cfg, metrics.NewRegistry(), zap.NewNop().Sugar())
+
+	decoder, err := NewDecoder(cfg.Format, &cfg.Timestamps, cfg.TopicIDs)
+	require.NoError(t, err)
+	acl, err := newSourceACL(cfg.Sources)
+	require.NoError(t, err)
+
+	storage := tm.NewTelemetryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- broker.run(ctx, sock, decoder, acl, storage)
+	}()
+	defer func() {
+		cancel()
+		sock.Close()
+		<-done
+	}()
+
+	conn, err := net.Dial("udp", sock.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	lines := make([]string, 0, 1000)
+	for id := 0; id < cap(lines); id++ {
+		lines = append(lines, fmt.Sprintf(`{"topic": "/home/sensor/%03d", "value": %d}`, id, id))
+	}
+	datagram := strings.Join(lines, "\n")
+	require.True(t, len(datagram) > 16*1024)
+
+	_, err = conn.Write([]byte(datagram))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ACK - 1000", string(buf[:n]))
+
+	assert.Len(t, storage.Read("/home/sensor/+"), 1000)
+}
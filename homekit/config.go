@@ -1,20 +1,32 @@
 package homekit
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
 
+	"homekit-ng/homekit/broker"
+	"homekit-ng/homekit/derive"
 	"homekit-ng/homekit/device"
+	"homekit-ng/homekit/persist"
 	"homekit-ng/homekit/publish"
+	"homekit-ng/homekit/tm"
 )
 
 type Config struct {
 	Logging  LoggingConfig
 	Tracking TrackingConfig
-	Broker   BrokerConfig
-	Influx   publish.InfluxConfig
+	// Broker is the single UDP broker, which is used only when no Brokers
+	// are configured.
+	Broker       BrokerConfig
+	Brokers      []*broker.Config
+	MemoryBroker broker.MemoryConfig `yaml:"memory_broker"`
+	Influx       publish.InfluxConfig
+	Telemetry    tm.Config
+	Persist      persist.Config
+	Derived      []*derive.Config
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -28,9 +40,31 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// Validate checks the broker configuration, including disabled brokers and
+// the legacy UDP broker, which is otherwise validated only when it runs.
+func (m *Config) Validate() error {
+	if len(m.Brokers) == 0 {
+		if err := m.Broker.Validate(); err != nil {
+			return fmt.Errorf("invalid broker: %v", err)
+		}
+	}
+
+	for id, cfg := range m.Brokers {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid broker #%d: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
 type LoggingConfig struct {
 	Level zapcore.Level
 }
@@ -39,6 +73,4 @@ type TrackingConfig struct {
 	Devices map[string]*device.TrackingConfig
 }
 
-type BrokerConfig struct {
-	Port uint16
-}
+type BrokerConfig = broker.UDPConfig
@@ -0,0 +1,35 @@
+package homekit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSampleConfig(t *testing.T) {
+	cfg, err := LoadConfig("../etc/homekit/homekit.yaml")
+	require.NoError(t, err)
+	assert.NotEmpty(t, cfg.Brokers)
+}
+
+func TestLoadConfigInvalidBrokers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "homekit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{
+		"legacy":        "broker:\n  format: xml\n",
+		"disabled":      "brokers:\n  - type: http\n    disabled: true\n",
+		"disabled type": "brokers:\n  - type: carrier-pigeon\n    disabled: true\n",
+	} {
+		path := filepath.Join(dir, "homekit.yaml")
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+		_, err := LoadConfig(path)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,216 @@
+package derive
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+// Config describes a derived topic, which is computed from other topics.
+type Config struct {
+	// Topic is the derived topic.
+	Topic string
+	// Expr is the expression the topic value is computed with, see Expr.
+	Expr string
+}
+
+type derivedTopic struct {
+	topic  string
+	expr   Expr
+	inputs []*tm.Pattern
+}
+
+func (m *derivedTopic) dependsOn(topic tm.Topic) bool {
+	for _, input := range m.inputs {
+		if input.Match(topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Engine re-evaluates derived topics whenever their inputs change and
+// stores the results as ordinary telemetry.
+type Engine struct {
+	topics  []*derivedTopic
+	storage *tm.TelemetryStorage
+	log     *zap.SugaredLogger
+}
+
+func NewEngine(cfgs []*Config, storage *tm.TelemetryStorage, log *zap.SugaredLogger) (*Engine, error) {
+	topics := make([]*derivedTopic, len(cfgs))
+	for id, cfg := range cfgs {
+		if tm.IsWildcard(cfg.Topic) || len(cfg.Topic) == 0 {
+			return nil, fmt.Errorf("invalid derived topic: %q", cfg.Topic)
+		}
+
+		expr, err := Compile(cfg.Expr)
+		if err != nil {
+			return nil, err
+		}
+
+		var inputs []*tm.Pattern
+		for _, topic := range expr.Topics() {
+			pattern, err := tm.CompilePattern(topic)
+			if err != nil {
+				return nil, fmt.Errorf("invalid input of %s: %v", cfg.Topic, err)
+			}
+
+			inputs = append(inputs, pattern)
+		}
+
+		topics[id] = &derivedTopic{
+			topic:  cfg.Topic,
+			expr:   expr,
+			inputs: inputs,
+		}
+	}
+
+	if err := checkCycles(topics); err != nil {
+		return nil, err
+	}
+
+	m := &Engine{
+		topics:  topics,
+		storage: storage,
+		log:     log,
+	}
+
+	return m, nil
+}
+
+// checkCycles ensures that no derived topic depends on itself, directly or
+// through other derived topics.
+func checkCycles(topics []*derivedTopic) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(topics))
+
+	var visit func(id int) error
+	visit = func(id int) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("derived topic %s depends on itself", topics[id].topic)
+		case visited:
+			return nil
+		}
+
+		state[id] = visiting
+		for dependency, topic := range topics {
+			if topics[id].dependsOn(topic.topic) {
+				if err := visit(dependency); err != nil {
+					return err
+				}
+			}
+		}
+		state[id] = visited
+
+		return nil
+	}
+
+	for id := range topics {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Engine) Run(ctx context.Context) error {
+	subscription, err := m.storage.Subscribe(tm.MultiLevelWildcard, tm.SubscribeOptions{
+		Capacity: 1024,
+		Policy:   tm.DropOldest,
+	})
+	if err != nil {
+		return err
+	}
+	defer subscription.Unsubscribe()
+
+	// Evaluate everything once to catch up with the restored telemetry.
+	m.evaluate(m.topics)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case telemetry := <-subscription.C():
+			changed := []*tm.Telemetry{telemetry}
+			// Coalesce pending telemetry to evaluate each derived topic
+			// once per batch.
+			for len(subscription.C()) > 0 {
+				changed = append(changed, <-subscription.C())
+			}
+
+			m.evaluate(m.affected(changed))
+		}
+	}
+}
+
+func (m *Engine) affected(telemetries []*tm.Telemetry) []*derivedTopic {
+	var topics []*derivedTopic
+	for _, topic := range m.topics {
+		for _, telemetry := range telemetries {
+			if topic.dependsOn(telemetry.Topic) {
+				topics = append(topics, topic)
+				break
+			}
+		}
+	}
+
+	return topics
+}
+
+func (m *Engine) evaluate(topics []*derivedTopic) {
+	if len(topics) == 0 {
+		return
+	}
+
+	env := &storageEnv{storage: m.storage, now: time.Now()}
+
+	var telemetries []*tm.Telemetry
+	for _, topic := range topics {
+		v, err := scalar(topic.expr, env)
+		if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			err = fmt.Errorf("non-finite result %v", v)
+		}
+		if err != nil {
+			m.log.Warnf("skipped evaluating %s: %v", topic.topic, err)
+			continue
+		}
+
+		telemetries = append(telemetries, tm.NewTelemetry(topic.topic, tm.Float(v)))
+	}
+
+	if len(telemetries) > 0 {
+		m.storage.PutMulti(telemetries)
+	}
+}
+
+// storageEnv resolves topics into the latest fresh numeric values from the
+// storage.
+type storageEnv struct {
+	storage *tm.TelemetryStorage
+	now     time.Time
+}
+
+func (m *storageEnv) Values(pattern string) []float64 {
+	var values []float64
+	for _, telemetry := range m.storage.Fresh(m.storage.Read(pattern), m.now) {
+		if v, ok := telemetry.Value.Numeric(); ok {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
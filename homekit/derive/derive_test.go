@@ -0,0 +1,84 @@
+package derive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/tm"
+)
+
+func TestNewEngineCycles(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	_, err := NewEngine([]*Config{
+		{Topic: "/home/a", Expr: `"/home/b" + 1`},
+		{Topic: "/home/b", Expr: `max("/home/+") * 2`},
+	}, storage, zap.NewNop().Sugar())
+	assert.Error(t, err)
+
+	_, err = NewEngine([]*Config{
+		{Topic: "/home/+/max", Expr: `1`},
+	}, storage, zap.NewNop().Sugar())
+	assert.Error(t, err)
+}
+
+func TestEngine(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	engine, err := NewEngine([]*Config{
+		{Topic: "/home/co2_max", Expr: `max("/home/+/co2")`},
+		{Topic: "/home/co2_alarm", Expr: `"/home/co2_max" - 1000`},
+	}, storage, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- engine.Run(ctx)
+	}()
+
+	// The subscription is not guaranteed to be established at this point,
+	// so keep putting until the derived value appears.
+	deadline := time.Now().Add(time.Second)
+	for len(storage.Read("/home/co2_alarm")) == 0 {
+		require.True(t, time.Now().Before(deadline), "derived topic was not evaluated in time")
+
+		storage.PutMulti([]*tm.Telemetry{
+			tm.NewTelemetry("/home/kitchen/co2", tm.Float(800)),
+			tm.NewTelemetry("/home/bedroom/co2", tm.Int(1200)),
+		})
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, tm.Float(1200), storage.Read("/home/co2_max")[0].Value)
+	assert.Equal(t, tm.Float(200), storage.Read("/home/co2_alarm")[0].Value)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestEngineNonFinite(t *testing.T) {
+	storage := tm.NewTelemetryStorage()
+
+	engine, err := NewEngine([]*Config{
+		{Topic: "/home/ratio", Expr: `"/home/a" / "/home/b"`},
+	}, storage, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	storage.PutMulti([]*tm.Telemetry{
+		tm.NewTelemetry("/home/a", tm.Float(1)),
+		tm.NewTelemetry("/home/b", tm.Float(0)),
+	})
+	engine.evaluate(engine.topics)
+	assert.Empty(t, storage.Read("/home/ratio"))
+
+	storage.PutMulti([]*tm.Telemetry{tm.NewTelemetry("/home/b", tm.Float(4))})
+	engine.evaluate(engine.topics)
+	require.Len(t, storage.Read("/home/ratio"), 1)
+	assert.Equal(t, tm.Float(0.25), storage.Read("/home/ratio")[0].Value)
+}
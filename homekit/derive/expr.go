@@ -0,0 +1,405 @@
+package derive
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Env resolves topic patterns referenced by expressions into values.
+type Env interface {
+	Values(pattern string) []float64
+}
+
+// Expr is a compiled expression over telemetry topics.
+//
+// Topics are referenced as double-quoted strings, which may contain
+// MQTT-style wildcards when used as arguments of aggregate functions, e.g.
+// `max("/home/+/co2")` or `("/home/temp" - 32) / 1.8`.
+type Expr interface {
+	// Eval evaluates the expression, returning a set of values for
+	// wildcard topic references and a single value otherwise.
+	Eval(env Env) ([]float64, error)
+	// Topics returns every topic pattern the expression depends on.
+	Topics() []string
+}
+
+type numberExpr struct {
+	value float64
+}
+
+func (m *numberExpr) Eval(env Env) ([]float64, error) {
+	return []float64{m.value}, nil
+}
+
+func (m *numberExpr) Topics() []string {
+	return nil
+}
+
+type topicExpr struct {
+	pattern string
+}
+
+func (m *topicExpr) Eval(env Env) ([]float64, error) {
+	values := env.Values(m.pattern)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no value for %q", m.pattern)
+	}
+
+	return values, nil
+}
+
+func (m *topicExpr) Topics() []string {
+	return []string{m.pattern}
+}
+
+type unaryExpr struct {
+	op   byte
+	expr Expr
+}
+
+func (m *unaryExpr) Eval(env Env) ([]float64, error) {
+	v, err := scalar(m.expr, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return []float64{-v}, nil
+}
+
+func (m *unaryExpr) Topics() []string {
+	return m.expr.Topics()
+}
+
+type binaryExpr struct {
+	op          byte
+	left, right Expr
+}
+
+func (m *binaryExpr) Eval(env Env) ([]float64, error) {
+	left, err := scalar(m.left, env)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := scalar(m.right, env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch m.op {
+	case '+':
+		return []float64{left + right}, nil
+	case '-':
+		return []float64{left - right}, nil
+	case '*':
+		return []float64{left * right}, nil
+	case '/':
+		if right == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return []float64{left / right}, nil
+	default:
+		return nil, fmt.Errorf("unknown operator: %c", m.op)
+	}
+}
+
+func (m *binaryExpr) Topics() []string {
+	return append(m.left.Topics(), m.right.Topics()...)
+}
+
+type callExpr struct {
+	name string
+	fn   *function
+	args []Expr
+}
+
+func (m *callExpr) Eval(env Env) ([]float64, error) {
+	var args []float64
+	for _, arg := range m.args {
+		var values []float64
+		var err error
+		if m.fn.Aggregate {
+			values, err = arg.Eval(env)
+		} else {
+			var v float64
+			v, err = scalar(arg, env)
+			values = []float64{v}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.name, err)
+		}
+
+		args = append(args, values...)
+	}
+
+	v, err := m.fn.Call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", m.name, err)
+	}
+
+	return []float64{v}, nil
+}
+
+func (m *callExpr) Topics() []string {
+	var topics []string
+	for _, arg := range m.args {
+		topics = append(topics, arg.Topics()...)
+	}
+
+	return topics
+}
+
+// scalar evaluates the expression in a scalar context, where a wildcard
+// topic reference must resolve into exactly one value.
+func scalar(expr Expr, env Env) (float64, error) {
+	values, err := expr.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(values) != 1 {
+		return 0, fmt.Errorf("expected a single value, got %d", len(values))
+	}
+
+	return values[0], nil
+}
+
+// Compile parses the given expression.
+func Compile(v string) (Expr, error) {
+	p := &parser{input: v}
+
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", v, err)
+	}
+
+	p.skipSpaces()
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("invalid expression %q: unexpected %q at %d", v, p.input[p.pos:], p.pos)
+	}
+
+	return expr, nil
+}
+
+// parser is a recursive descent parser of the following grammar:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | string | ident "(" [ expr { "," expr } ] ")" | "(" expr ")"
+type parser struct {
+	input string
+	pos   int
+}
+
+func (m *parser) skipSpaces() {
+	for m.pos < len(m.input) && unicode.IsSpace(rune(m.input[m.pos])) {
+		m.pos++
+	}
+}
+
+func (m *parser) peek() byte {
+	m.skipSpaces()
+	if m.pos >= len(m.input) {
+		return 0
+	}
+
+	return m.input[m.pos]
+}
+
+func (m *parser) expect(c byte) error {
+	if m.peek() != c {
+		return m.unexpected(fmt.Sprintf("%q", c))
+	}
+
+	m.pos++
+	return nil
+}
+
+func (m *parser) unexpected(expected string) error {
+	if m.pos >= len(m.input) {
+		return fmt.Errorf("expected %s, got end of input", expected)
+	}
+
+	return fmt.Errorf("expected %s at %d, got %q", expected, m.pos, m.input[m.pos])
+}
+
+func (m *parser) parseExpr() (Expr, error) {
+	left, err := m.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := m.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		m.pos++
+
+		right, err := m.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (m *parser) parseTerm() (Expr, error) {
+	left, err := m.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := m.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		m.pos++
+
+		right, err := m.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (m *parser) parseUnary() (Expr, error) {
+	if m.peek() == '-' {
+		m.pos++
+
+		expr, err := m.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &unaryExpr{op: '-', expr: expr}, nil
+	}
+
+	return m.parsePrimary()
+}
+
+func (m *parser) parsePrimary() (Expr, error) {
+	c := m.peek()
+
+	switch {
+	case c == '(':
+		m.pos++
+
+		expr, err := m.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := m.expect(')'); err != nil {
+			return nil, err
+		}
+
+		return expr, nil
+	case c == '"':
+		return m.parseTopic()
+	case c == '.' || isDigit(c):
+		return m.parseNumber()
+	case isIdentStart(c):
+		return m.parseCall()
+	default:
+		return nil, m.unexpected("a number, a topic, a function call or '('")
+	}
+}
+
+func (m *parser) parseTopic() (Expr, error) {
+	start := m.pos
+	end := strings.IndexByte(m.input[start+1:], '"')
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated topic at %d", start)
+	}
+
+	pattern := m.input[start+1 : start+1+end]
+	m.pos = start + end + 2
+
+	if len(pattern) == 0 {
+		return nil, fmt.Errorf("empty topic at %d", start)
+	}
+
+	return &topicExpr{pattern: pattern}, nil
+}
+
+func (m *parser) parseNumber() (Expr, error) {
+	start := m.pos
+	for m.pos < len(m.input) {
+		c := m.input[m.pos]
+		isExponent := c == 'e' || c == 'E'
+		isExponentSign := (c == '+' || c == '-') && (m.input[m.pos-1] == 'e' || m.input[m.pos-1] == 'E')
+		if !isDigit(c) && c != '.' && !isExponent && !isExponentSign {
+			break
+		}
+		m.pos++
+	}
+
+	value, err := strconv.ParseFloat(m.input[start:m.pos], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number at %d: %v", start, err)
+	}
+
+	return &numberExpr{value: value}, nil
+}
+
+func (m *parser) parseCall() (Expr, error) {
+	start := m.pos
+	for m.pos < len(m.input) && (isIdentStart(m.input[m.pos]) || isDigit(m.input[m.pos])) {
+		m.pos++
+	}
+
+	name := strings.ToLower(m.input[start:m.pos])
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name, start)
+	}
+
+	if err := m.expect('('); err != nil {
+		return nil, err
+	}
+
+	var args []Expr
+	if m.peek() != ')' {
+		for {
+			arg, err := m.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if m.peek() != ',' {
+				break
+			}
+			m.pos++
+		}
+	}
+
+	if err := m.expect(')'); err != nil {
+		return nil, err
+	}
+
+	if fn.Arity > 0 && len(args) != fn.Arity {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, fn.Arity, len(args))
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s expects at least one argument", name)
+	}
+
+	return &callExpr{name: name, fn: fn, args: args}, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,114 @@
+package derive
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+type mapEnv map[string]float64
+
+func (m mapEnv) Values(pattern string) []float64 {
+	var values []float64
+	for topic, value := range m {
+		if tm.Match(pattern, topic) {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+func TestEval(t *testing.T) {
+	env := mapEnv{
+		"/home/kitchen/temp": 20,
+		"/home/kitchen/co2":  800,
+		"/home/bedroom/co2":  1200,
+		"/home/outdoor/temp": 68,
+	}
+
+	tests := []struct {
+		expr  string
+		value float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-2 - -3", 1},
+		{"1e-1 * 10", 1},
+		{`("/home/outdoor/temp" - 32) / 1.8`, 20},
+		{`max("/home/+/co2")`, 1200},
+		{`min("/home/+/co2", 900)`, 800},
+		{`avg("/home/+/co2")`, 1000},
+		{`count("/home/#")`, 4},
+		{`sum("/home/+/co2") / 2`, 1000},
+		{`abs("/home/kitchen/temp" - 25)`, 5},
+	}
+
+	for _, test := range tests {
+		expr, err := Compile(test.expr)
+		require.NoError(t, err, test.expr)
+
+		v, err := scalar(expr, env)
+		require.NoError(t, err, test.expr)
+		assert.InDelta(t, test.value, v, 1e-9, test.expr)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	env := mapEnv{
+		"/home/kitchen/co2": 800,
+		"/home/bedroom/co2": 1200,
+	}
+
+	for _, v := range []string{
+		`"/home/+/co2" + 1`,
+		`"/home/kitchen/temp"`,
+		`1 / 0`,
+		`max("/home/+/temp")`,
+	} {
+		expr, err := Compile(v)
+		require.NoError(t, err, v)
+
+		_, err = scalar(expr, env)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, v := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		`"/home/temp`,
+		`unknown("/home/temp")`,
+		`dewpoint("/home/temp")`,
+		`max()`,
+		"1 2",
+	} {
+		_, err := Compile(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestCompileTopics(t *testing.T) {
+	expr, err := Compile(`dewpoint("/home/kitchen/temp", "/home/kitchen/humidity") - min("/home/+/temp")`)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/home/kitchen/temp", "/home/kitchen/humidity", "/home/+/temp"}, expr.Topics())
+}
+
+func TestBuiltins(t *testing.T) {
+	v, err := dewPoint([]float64{20, 50})
+	require.NoError(t, err)
+	assert.InDelta(t, 9.26, v, 0.01)
+
+	v, err = absoluteHumidity([]float64{20, 50})
+	require.NoError(t, err)
+	assert.InDelta(t, 8.64, v, 0.01)
+
+	_, err = dewPoint([]float64{20, 0})
+	assert.Error(t, err)
+}
@@ -0,0 +1,98 @@
+package derive
+
+import (
+	"fmt"
+	"math"
+)
+
+type function struct {
+	// Arity is the number of arguments. Zero means variadic.
+	Arity int
+	// Aggregate functions accept wildcard topic sets as arguments, which
+	// are flattened into the argument list.
+	Aggregate bool
+	Call      func(args []float64) (float64, error)
+}
+
+var functions = map[string]*function{
+	"min":         {Aggregate: true, Call: minOf},
+	"max":         {Aggregate: true, Call: maxOf},
+	"avg":         {Aggregate: true, Call: avgOf},
+	"sum":         {Aggregate: true, Call: sumOf},
+	"count":       {Aggregate: true, Call: countOf},
+	"abs":         {Arity: 1, Call: absOf},
+	"dewpoint":    {Arity: 2, Call: dewPoint},
+	"abshumidity": {Arity: 2, Call: absoluteHumidity},
+}
+
+func minOf(args []float64) (float64, error) {
+	v := math.Inf(1)
+	for _, arg := range args {
+		v = math.Min(v, arg)
+	}
+
+	return v, nil
+}
+
+func maxOf(args []float64) (float64, error) {
+	v := math.Inf(-1)
+	for _, arg := range args {
+		v = math.Max(v, arg)
+	}
+
+	return v, nil
+}
+
+func sumOf(args []float64) (float64, error) {
+	v := 0.0
+	for _, arg := range args {
+		v += arg
+	}
+
+	return v, nil
+}
+
+func avgOf(args []float64) (float64, error) {
+	v, err := sumOf(args)
+	if err != nil {
+		return 0, err
+	}
+
+	return v / float64(len(args)), nil
+}
+
+func countOf(args []float64) (float64, error) {
+	return float64(len(args)), nil
+}
+
+func absOf(args []float64) (float64, error) {
+	return math.Abs(args[0]), nil
+}
+
+// dewPoint calculates the dew point in °C from the temperature in °C and
+// the relative humidity in percents using the Magnus formula.
+func dewPoint(args []float64) (float64, error) {
+	temp, humidity := args[0], args[1]
+	if humidity <= 0 || humidity > 100 {
+		return 0, fmt.Errorf("relative humidity out of range: %v", humidity)
+	}
+
+	const a, b = 17.62, 243.12
+
+	gamma := math.Log(humidity/100) + a*temp/(b+temp)
+
+	return b * gamma / (a - gamma), nil
+}
+
+// absoluteHumidity calculates the absolute humidity in g/m³ from the
+// temperature in °C and the relative humidity in percents.
+func absoluteHumidity(args []float64) (float64, error) {
+	temp, humidity := args[0], args[1]
+	if humidity < 0 || humidity > 100 {
+		return 0, fmt.Errorf("relative humidity out of range: %v", humidity)
+	}
+
+	saturation := 6.112 * math.Exp(17.67*temp/(temp+243.5))
+
+	return saturation * humidity * 2.1674 / (273.15 + temp), nil
+}
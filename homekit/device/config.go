@@ -11,6 +11,8 @@ import (
 
 	"homekit-ng/homekit/device/neighbor"
 	"homekit-ng/homekit/device/tracker"
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
 )
 
 type TrackingConfig struct {
@@ -49,6 +51,7 @@ func NewTrackingMethodFactory(cfg *TrackingMethodConfig) (TrackingMethodFactory,
 				Port:     args.Port,
 				Interval: args.Interval,
 				Log:      log,
+				Failures: newFailuresCounter(cfg.Type, mac),
 			}, nil
 		}, nil
 	case "ping":
@@ -68,6 +71,7 @@ func NewTrackingMethodFactory(cfg *TrackingMethodConfig) (TrackingMethodFactory,
 				Locator:  &neighbor.ARPNeighborLocator{},
 				Interval: args.Interval,
 				Log:      log,
+				Failures: newFailuresCounter(cfg.Type, mac),
 			}, nil
 		}, nil
 	case "pcap":
@@ -87,9 +91,10 @@ func NewTrackingMethodFactory(cfg *TrackingMethodConfig) (TrackingMethodFactory,
 			}
 
 			return &tracker.PCapCheck{
-				Device: args.Dev,
-				Filter: filter,
-				Log:    log,
+				Device:   args.Dev,
+				Filter:   filter,
+				Log:      log,
+				Failures: newFailuresCounter(cfg.Type, mac),
 			}, nil
 		}, nil
 	default:
@@ -97,6 +102,10 @@ func NewTrackingMethodFactory(cfg *TrackingMethodConfig) (TrackingMethodFactory,
 	}
 }
 
+func newFailuresCounter(method string, mac net.HardwareAddr) *metrics.Counter {
+	return metrics.NewCounter("tracker/failures", tm.Labels{"method": method, "mac": mac.String()})
+}
+
 func transcode(v, o interface{}) error {
 	b, err := yaml.Marshal(v)
 	if err != nil {
@@ -9,6 +9,9 @@ import (
 
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
 )
 
 type activityData struct {
@@ -58,6 +61,7 @@ func (m *ActivityTracker) HardwareLastSeen(mac string) time.Time {
 
 func (m *ActivityTracker) Register(mac net.HardwareAddr, cfg *TrackingConfig) error {
 	methods := make([]Tracker, len(cfg.Methods))
+	names := make([]string, len(cfg.Methods))
 	for id, methodConfig := range cfg.Methods {
 		factory, err := NewTrackingMethodFactory(methodConfig)
 		if err != nil {
@@ -70,9 +74,10 @@ func (m *ActivityTracker) Register(mac net.HardwareAddr, cfg *TrackingConfig) er
 		}
 
 		methods[id] = method
+		names[id] = methodConfig.Type
 	}
 
-	m.txrx <- &registerEvent{MAC: mac, Trackers: methods}
+	m.txrx <- &registerEvent{MAC: mac, Trackers: methods, Methods: names}
 
 	return nil
 }
@@ -111,28 +116,30 @@ func (m *ActivityTracker) watchDevice(ctx context.Context, ev *registerEvent) {
 		CancelFunc: cancelFunc,
 	}
 
-	m.spawnWatcher(ctx, ev.MAC, ev.Trackers)
+	m.spawnWatcher(ctx, ev)
 }
 
-func (m *ActivityTracker) spawnWatcher(ctx context.Context, mac net.HardwareAddr, trackers []Tracker) {
+func (m *ActivityTracker) spawnWatcher(ctx context.Context, ev *registerEvent) {
 	go func() {
-		if err := m.watch(ctx, mac, trackers); err != nil {
-			m.log.Warnf("stopped watching for %s: %v", mac, err)
+		if err := m.watch(ctx, ev.MAC, ev.Trackers, ev.Methods); err != nil {
+			m.log.Warnf("stopped watching for %s: %v", ev.MAC, err)
 		}
 	}()
 }
 
-func (m *ActivityTracker) watch(ctx context.Context, mac net.HardwareAddr, trackers []Tracker) error {
+func (m *ActivityTracker) watch(ctx context.Context, mac net.HardwareAddr, trackers []Tracker, methods []string) error {
 	m.log.Infof("watching for %s", mac)
 	defer m.log.Infof("stopped watching for %s", mac)
 
 	wg, ctx := errgroup.WithContext(ctx)
-	for _, tracker := range trackers {
+	for id, tracker := range trackers {
 		tracker := tracker
+		activity := metrics.NewCounter("tracker/activity", tm.Labels{"method": methods[id], "mac": mac.String()})
 
 		wg.Go(func() error {
 			return tracker.Run(ctx, func() {
 				m.log.Debugf("detected %T activity", tracker)
+				activity.Inc()
 				m.updateLastSeen(mac)
 			})
 		})
@@ -156,4 +163,6 @@ func (m *ActivityTracker) updateLastSeen(mac net.HardwareAddr) {
 type registerEvent struct {
 	MAC      net.HardwareAddr
 	Trackers []Tracker
+	// Methods are tracking method names of corresponding trackers.
+	Methods []string
 }
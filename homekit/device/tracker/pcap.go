@@ -14,6 +14,8 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/net/bpf"
 	"golang.org/x/sync/errgroup"
+
+	"homekit-ng/homekit/metrics"
 )
 
 const (
@@ -28,9 +30,21 @@ type PCapCheck struct {
 	Filter []bpf.RawInstruction
 	// Logger.
 	Log *zap.SugaredLogger
+	// Failures counts capture failures, optional.
+	Failures *metrics.Counter
 }
 
 func (m *PCapCheck) Run(ctx context.Context, onActivity func()) error {
+	err := m.run(ctx, onActivity)
+	// Capture errors are fatal, but cancellation is not a failure.
+	if err != nil && ctx.Err() == nil {
+		m.Failures.Inc()
+	}
+
+	return err
+}
+
+func (m *PCapCheck) run(ctx context.Context, onActivity func()) error {
 	handle, err := pcapgo.NewEthernetHandle(m.Device)
 	if err != nil {
 		return err
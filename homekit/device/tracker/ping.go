@@ -9,6 +9,7 @@ import (
 	"go.uber.org/zap"
 
 	"homekit-ng/homekit/device/neighbor"
+	"homekit-ng/homekit/metrics"
 )
 
 type PingCheck struct {
@@ -20,6 +21,8 @@ type PingCheck struct {
 	Interval time.Duration
 	// Log is a logger.
 	Log *zap.SugaredLogger
+	// Failures counts failed checks, optional.
+	Failures *metrics.Counter
 }
 
 func (m *PingCheck) Run(ctx context.Context, onActivity func()) error {
@@ -30,6 +33,7 @@ func (m *PingCheck) Run(ctx context.Context, onActivity func()) error {
 		default:
 			if err := m.run(ctx, onActivity); err != nil {
 				m.Log.Warnf("failed to execute %T: %v", m, err)
+				m.Failures.Inc()
 				time.Sleep(m.Interval)
 				continue
 			}
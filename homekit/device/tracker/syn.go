@@ -9,6 +9,7 @@ import (
 	"go.uber.org/zap"
 
 	"homekit-ng/homekit/device/neighbor"
+	"homekit-ng/homekit/metrics"
 )
 
 // SYNCheck is a check that sends TCP SYN packets to the specified address
@@ -24,6 +25,8 @@ type SYNCheck struct {
 	Interval time.Duration
 	// Internal logger, mainly for debugging purposes.
 	Log *zap.SugaredLogger
+	// Failures counts failed checks, optional.
+	Failures *metrics.Counter
 }
 
 // OnActivity is called when a tracker detects any activity on the target.
@@ -39,6 +42,7 @@ func (m *SYNCheck) Run(ctx context.Context, onActivity func()) error {
 			err := m.execute(ctx)
 			if err != nil {
 				m.Log.Warnf("failed to execute %T: %v", m, err)
+				m.Failures.Inc()
 				continue
 			}
 
@@ -2,10 +2,16 @@ package homekit
 
 import (
 	"context"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
+	"homekit-ng/homekit/metrics"
 	"homekit-ng/homekit/tm"
 )
 
@@ -13,29 +19,79 @@ type Broker interface {
 	Run(ctx context.Context, tm *tm.TelemetryStorage) error
 }
 
+const (
+	stalenessCheckInterval = 30 * time.Second
+	metricsInterval        = 10 * time.Second
+)
+
 type Hub struct {
+	cfg     tm.Config
 	tm      *tm.TelemetryStorage
 	brokers []Broker
 	log     *zap.SugaredLogger
+
+	mu    sync.Mutex
+	stale []string
 }
 
-func NewHub(log *zap.SugaredLogger) *Hub {
-	return &Hub{
-		tm:  tm.NewTelemetryStorage(),
+func NewHub(cfg tm.Config, log *zap.SugaredLogger) (*Hub, error) {
+	storage, err := tm.NewTelemetryStorageWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hub := &Hub{
+		cfg: cfg,
+		tm:  storage,
 		log: log,
 	}
+
+	metrics.Default.CounterFunc("storage/puts", nil, func() uint64 {
+		return storage.Stats().Puts
+	})
+	metrics.Default.GaugeFunc("storage/series", nil, func() float64 {
+		return float64(storage.Stats().Series)
+	})
+	metrics.Default.GaugeFunc("runtime/goroutines", nil, func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	metrics.Default.GaugeFunc("runtime/heap_bytes", nil, func() float64 {
+		memStats := runtime.MemStats{}
+		runtime.ReadMemStats(&memStats)
+		return float64(memStats.HeapAlloc)
+	})
+	metrics.Default.GaugeFunc("stale/count", nil, func() float64 {
+		return float64(len(hub.StaleSensors()))
+	})
+
+	return hub, nil
 }
 
 func (m *Hub) Telemetries() *tm.TelemetryStorage {
 	return m.tm
 }
 
+// StaleSensors returns sorted series keys of telemetry that stopped
+// reporting, as of the last staleness check.
+func (m *Hub) StaleSensors() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string(nil), m.stale...)
+}
+
 func (m *Hub) AddBroker(broker Broker) {
 	m.brokers = append(m.brokers, broker)
 }
 
 func (m *Hub) Run(ctx context.Context) error {
 	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		return m.watchStaleness(ctx)
+	})
+	wg.Go(func() error {
+		return metrics.Default.Run(ctx, m.tm, metricsInterval)
+	})
 
 	for _, broker := range m.brokers {
 		broker := broker
@@ -50,3 +106,75 @@ func (m *Hub) Run(ctx context.Context) error {
 
 	return wg.Wait()
 }
+
+// watchStaleness periodically checks for sensors that stopped reporting or
+// recovered, evicting stale telemetry if configured.
+func (m *Hub) watchStaleness(ctx context.Context) error {
+	timer := time.NewTicker(stalenessCheckInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-timer.C:
+			m.checkStaleness(now)
+		}
+	}
+}
+
+// checkStaleness logs changes of the stale sensor list and publishes it
+// into the storage as the space-separated "/homekit/internal/stale/sensors"
+// string.
+//
+// Evicted sensors stay in the list until they report again.
+func (m *Hub) checkStaleness(now time.Time) {
+	var telemetries []*tm.Telemetry
+	if m.cfg.Staleness.Evict {
+		telemetries = m.tm.EvictStale(now)
+	} else {
+		telemetries = m.tm.Stale(now)
+	}
+
+	previous := map[string]bool{}
+	for _, key := range m.StaleSensors() {
+		previous[key] = true
+	}
+
+	current := map[string]bool{}
+	keys := make([]string, 0, len(telemetries))
+	for _, telemetry := range telemetries {
+		key := telemetry.Key()
+		current[key] = true
+		keys = append(keys, key)
+
+		if !previous[key] {
+			m.log.Warnf("%s is stale, last seen at %s", key, telemetry.Timestamp.Format(time.RFC3339))
+		}
+	}
+
+	stored := map[string]bool{}
+	for _, telemetry := range m.tm.Read(tm.MultiLevelWildcard) {
+		stored[telemetry.Key()] = true
+	}
+
+	for key := range previous {
+		switch {
+		case current[key]:
+		case stored[key]:
+			m.log.Infof("%s is fresh again", key)
+		default:
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	m.mu.Lock()
+	m.stale = keys
+	m.mu.Unlock()
+
+	sensors := tm.NewTelemetry(metrics.Prefix+"/stale/sensors", tm.String(strings.Join(keys, " ")))
+	sensors.Timestamp = now
+	m.tm.PutMulti([]*tm.Telemetry{sensors})
+}
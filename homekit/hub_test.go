@@ -0,0 +1,67 @@
+package homekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+func TestHubStaleSensors(t *testing.T) {
+	cfg := tm.Config{
+		Staleness: tm.StalenessConfig{MaxAge: time.Minute},
+	}
+
+	hub, err := NewHub(cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	now := time.Now()
+	temp := tm.NewTelemetry("/home/temp", tm.Float(21))
+	temp.Timestamp = now.Add(-2 * time.Minute)
+	door := tm.NewTelemetry("/home/door", tm.Bool(true))
+	door.Timestamp = now.Add(-3 * time.Minute)
+	hub.Telemetries().PutMulti([]*tm.Telemetry{temp, door, tm.NewTelemetry("/home/light", tm.Bool(false))})
+
+	hub.checkStaleness(now)
+
+	assert.Equal(t, []string{"/home/door", "/home/temp"}, hub.StaleSensors())
+
+	sensors := hub.Telemetries().Read(metrics.Prefix + "/stale/sensors")
+	require.Len(t, sensors, 1)
+	assert.Equal(t, tm.String("/home/door /home/temp"), sensors[0].Value)
+}
+
+func TestHubStaleSensorsEvicted(t *testing.T) {
+	cfg := tm.Config{
+		Staleness: tm.StalenessConfig{MaxAge: time.Minute, Evict: true},
+	}
+
+	hub, err := NewHub(cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	now := time.Now()
+	temp := tm.NewTelemetry("/home/temp", tm.Float(21))
+	temp.Timestamp = now.Add(-2 * time.Minute)
+	door := tm.NewTelemetry("/home/door", tm.Bool(true))
+	door.Timestamp = now.Add(-3 * time.Minute)
+	hub.Telemetries().PutMulti([]*tm.Telemetry{temp, door})
+
+	hub.checkStaleness(now)
+	assert.Equal(t, []string{"/home/door", "/home/temp"}, hub.StaleSensors())
+	assert.Empty(t, hub.Telemetries().Read("/home/#"))
+
+	// Evicted sensors stay stale until they report again.
+	now = now.Add(30 * time.Second)
+	hub.Telemetries().PutMulti([]*tm.Telemetry{tm.NewTelemetry("/home/temp", tm.Float(22))})
+	hub.checkStaleness(now)
+	assert.Equal(t, []string{"/home/door"}, hub.StaleSensors())
+
+	sensors := hub.Telemetries().Read(metrics.Prefix + "/stale/sensors")
+	require.Len(t, sensors, 1)
+	assert.Equal(t, tm.String("/home/door"), sensors[0].Value)
+}
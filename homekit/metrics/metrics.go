@@ -0,0 +1,234 @@
+// Package metrics provides internal counters and gauges, which are
+// published into the telemetry storage like ordinary telemetry.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"homekit-ng/homekit/tm"
+)
+
+// Prefix is the reserved topic namespace of internal metrics.
+const Prefix = "/homekit/internal"
+
+// Counter is a monotonically increasing counter, published as an integer.
+//
+// A nil Counter discards increments, which frees optional instrumentation
+// from nil checks.
+type Counter struct {
+	v uint64
+}
+
+func (m *Counter) Inc() {
+	m.Add(1)
+}
+
+func (m *Counter) Add(n uint64) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.v, n)
+}
+
+func (m *Counter) Value() uint64 {
+	if m == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&m.v)
+}
+
+// Gauge is an arbitrary value, published as a float.
+//
+// Like Counter, a nil Gauge discards values.
+type Gauge struct {
+	bits uint64
+}
+
+func (m *Gauge) Set(v float64) {
+	if m == nil {
+		return
+	}
+
+	atomic.StoreUint64(&m.bits, math.Float64bits(v))
+}
+
+func (m *Gauge) Value() float64 {
+	if m == nil {
+		return 0
+	}
+
+	return math.Float64frombits(atomic.LoadUint64(&m.bits))
+}
+
+type entry struct {
+	topic  tm.Topic
+	labels tm.Labels
+	// metric is either *Counter or *Gauge, nil for function-backed
+	// metrics.
+	metric interface{}
+	value  func() tm.TelemetryValue
+}
+
+// Registry keeps metrics identified by their name and labels.
+//
+// Names are relative to Prefix, like "udp/datagrams".
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: map[string]*entry{},
+	}
+}
+
+// Default is the registry every component reports into.
+var Default = NewRegistry()
+
+// Counter returns the counter with the given name and labels, creating it
+// if necessary.
+//
+// Panics if there is a metric of another kind with the same name and
+// labels.
+func (m *Registry) Counter(name string, labels tm.Labels) *Counter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key(name, labels)]
+	if ok {
+		counter, ok := e.metric.(*Counter)
+		if !ok {
+			panic(fmt.Sprintf("metric %s is not a counter", name))
+		}
+		return counter
+	}
+
+	counter := &Counter{}
+	m.register(name, labels, counter, func() tm.TelemetryValue {
+		return tm.Int(int64(counter.Value()))
+	})
+
+	return counter
+}
+
+// Gauge returns the gauge with the given name and labels, creating it if
+// necessary.
+//
+// Panics if there is a metric of another kind with the same name and
+// labels.
+func (m *Registry) Gauge(name string, labels tm.Labels) *Gauge {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key(name, labels)]
+	if ok {
+		gauge, ok := e.metric.(*Gauge)
+		if !ok {
+			panic(fmt.Sprintf("metric %s is not a gauge", name))
+		}
+		return gauge
+	}
+
+	gauge := &Gauge{}
+	m.register(name, labels, gauge, func() tm.TelemetryValue {
+		return tm.Float(gauge.Value())
+	})
+
+	return gauge
+}
+
+// CounterFunc registers the counter backed by the given function, replacing
+// the previous metric with the same name and labels.
+func (m *Registry) CounterFunc(name string, labels tm.Labels, fn func() uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.register(name, labels, nil, func() tm.TelemetryValue {
+		return tm.Int(int64(fn()))
+	})
+}
+
+// GaugeFunc registers the gauge backed by the given function, replacing the
+// previous metric with the same name and labels.
+func (m *Registry) GaugeFunc(name string, labels tm.Labels, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.register(name, labels, nil, func() tm.TelemetryValue {
+		return tm.Float(fn())
+	})
+}
+
+func (m *Registry) register(name string, labels tm.Labels, metric interface{}, value func() tm.TelemetryValue) {
+	m.entries[key(name, labels)] = &entry{
+		topic:  Prefix + tm.TopicSeparator + name,
+		labels: labels,
+		metric: metric,
+		value:  value,
+	}
+}
+
+func key(name string, labels tm.Labels) string {
+	return name + labels.String()
+}
+
+// Collect returns current values of all metrics, ordered by topic and
+// labels.
+func (m *Registry) Collect(now time.Time) []*tm.Telemetry {
+	m.mu.Lock()
+	entries := make([]*entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+	m.mu.Unlock()
+
+	telemetries := make([]*tm.Telemetry, 0, len(entries))
+	for _, e := range entries {
+		telemetries = append(telemetries, &tm.Telemetry{
+			Topic:     e.topic,
+			Value:     e.value(),
+			Labels:    e.labels,
+			Timestamp: now,
+		})
+	}
+
+	sort.Slice(telemetries, func(i, j int) bool {
+		return telemetries[i].Key() < telemetries[j].Key()
+	})
+
+	return telemetries
+}
+
+// Run periodically puts all metrics into the storage.
+func (m *Registry) Run(ctx context.Context, storage *tm.TelemetryStorage, interval time.Duration) error {
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-timer.C:
+			storage.PutMulti(m.Collect(now))
+		}
+	}
+}
+
+// NewCounter is like Registry.Counter of the Default registry.
+func NewCounter(name string, labels tm.Labels) *Counter {
+	return Default.Counter(name, labels)
+}
+
+// NewGauge is like Registry.Gauge of the Default registry.
+func NewGauge(name string, labels tm.Labels) *Gauge {
+	return Default.Gauge(name, labels)
+}
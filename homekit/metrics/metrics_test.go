@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"homekit-ng/homekit/tm"
+)
+
+func TestRegistryCollect(t *testing.T) {
+	registry := NewRegistry()
+
+	counter := registry.Counter("udp/datagrams", tm.Labels{"addr": ":9090"})
+	counter.Inc()
+	counter.Add(2)
+	// The same name and labels refer to the same counter.
+	registry.Counter("udp/datagrams", tm.Labels{"addr": ":9090"}).Inc()
+
+	registry.Gauge("influx/push_seconds", nil).Set(0.25)
+	registry.CounterFunc("storage/puts", nil, func() uint64 { return 42 })
+	registry.GaugeFunc("runtime/goroutines", nil, func() float64 { return 7 })
+
+	now := time.Now()
+	telemetries := registry.Collect(now)
+	require.Len(t, telemetries, 4)
+
+	values := map[string]tm.TelemetryValue{}
+	for _, telemetry := range telemetries {
+		assert.True(t, now.Equal(telemetry.Timestamp))
+		values[telemetry.Key()] = telemetry.Value
+	}
+
+	assert.Equal(t, map[string]tm.TelemetryValue{
+		"/homekit/internal/udp/datagrams{addr=:9090}": tm.Int(4),
+		"/homekit/internal/influx/push_seconds":       tm.Float(0.25),
+		"/homekit/internal/storage/puts":              tm.Int(42),
+		"/homekit/internal/runtime/goroutines":        tm.Float(7),
+	}, values)
+}
+
+func TestRegistryKindMismatch(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("udp/datagrams", nil)
+
+	assert.Panics(t, func() {
+		registry.Gauge("udp/datagrams", nil)
+	})
+}
+
+func TestNilMetrics(t *testing.T) {
+	var counter *Counter
+	counter.Inc()
+	assert.Equal(t, uint64(0), counter.Value())
+
+	var gauge *Gauge
+	gauge.Set(1)
+	assert.Equal(t, 0.0, gauge.Value())
+}
+
+func TestRegistryRun(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("memory/dropped", nil).Inc()
+
+	storage := tm.NewTelemetryStorage()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, registry.Run(ctx, storage, 10*time.Millisecond))
+
+	telemetries := storage.Read(Prefix + "/#")
+	require.Len(t, telemetries, 1)
+	assert.Equal(t, tm.Int(1), telemetries[0].Value)
+}
@@ -0,0 +1,282 @@
+package persist
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "telemetry.log"
+
+	defaultInterval = 5 * time.Minute
+)
+
+type Config struct {
+	// Path is a directory where the snapshot and the append-only log are
+	// kept. Persistence is disabled when empty.
+	Path string
+	// Interval shows how often the snapshot is taken and the log is
+	// truncated.
+	//
+	// Defaults to 5m.
+	Interval time.Duration
+}
+
+func (m *Config) Enabled() bool {
+	return len(m.Path) != 0
+}
+
+func (m *Config) interval() time.Duration {
+	if m.Interval <= 0 {
+		return defaultInterval
+	}
+
+	return m.Interval
+}
+
+// Persister keeps the telemetry storage on disk across restarts.
+//
+// Every telemetry put into the storage is appended to the log for crash
+// safety. Periodically and on shutdown the whole storage is written into
+// the snapshot, after which the log is truncated.
+type Persister struct {
+	cfg     *Config
+	storage *tm.TelemetryStorage
+	log     *zap.SugaredLogger
+}
+
+func NewPersister(cfg *Config, storage *tm.TelemetryStorage, log *zap.SugaredLogger) *Persister {
+	return &Persister{
+		cfg:     cfg,
+		storage: storage,
+		log:     log,
+	}
+}
+
+// Restore loads the snapshot and replays the log into the storage.
+//
+// Restored telemetries keep their original timestamps. Missing files are
+// not an error.
+func (m *Persister) Restore() error {
+	if err := os.MkdirAll(m.cfg.Path, 0755); err != nil {
+		return err
+	}
+
+	snapshot, err := m.readSnapshot()
+	if err != nil {
+		return err
+	}
+
+	replay, err := m.readLog()
+	if err != nil {
+		return err
+	}
+
+	m.storage.PutMulti(snapshot)
+	m.storage.PutMulti(replay)
+
+	m.log.Infof("restored %d telemetries from snapshot and %d from log", len(snapshot), len(replay))
+
+	return nil
+}
+
+func (m *Persister) Run(ctx context.Context) error {
+	// Dropping telemetry that does not fit keeps a slow disk from stalling
+	// the ingestion, the snapshot still catches up with it.
+	subscription, err := m.storage.Subscribe(tm.MultiLevelWildcard, tm.SubscribeOptions{
+		Capacity: 1024,
+		Policy:   tm.DropOldest,
+	})
+	if err != nil {
+		return err
+	}
+	defer subscription.Unsubscribe()
+
+	metrics.Default.CounterFunc("persist/dropped", nil, subscription.Dropped)
+
+	file, err := m.openLog()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			m.log.Warnf("failed to close telemetry log: %v", err)
+		}
+	}()
+
+	wr := bufio.NewWriter(file)
+
+	timer := time.NewTicker(m.cfg.interval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := m.snapshot(file, wr); err != nil {
+				m.log.Warnf("failed to snapshot telemetry on shutdown: %v", err)
+			}
+			return ctx.Err()
+		case <-timer.C:
+			if err := m.snapshot(file, wr); err != nil {
+				m.log.Warnf("failed to snapshot telemetry: %v", err)
+			}
+
+			if dropped := subscription.Dropped(); dropped > 0 {
+				m.log.Warnf("%d telemetries were not logged so far, persister is too slow", dropped)
+			}
+		case telemetry := <-subscription.C():
+			if err := writeRecord(wr, telemetry); err != nil {
+				m.log.Warnf("failed to log telemetry: %v", err)
+				continue
+			}
+
+			if len(subscription.C()) == 0 {
+				if err := wr.Flush(); err != nil {
+					m.log.Warnf("failed to flush telemetry log: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// snapshot writes the storage into a temporary file, atomically replaces
+// the previous snapshot with it and truncates the log.
+//
+// Telemetries that are put concurrently may end up both in the snapshot
+// and in the log, which is harmless since the log is replayed on top.
+func (m *Persister) snapshot(file *os.File, wr *bufio.Writer) error {
+	telemetries := m.storage.Read(tm.MultiLevelWildcard)
+
+	tmp, err := ioutil.TempFile(m.cfg.Path, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	records := make([]*record, len(telemetries))
+	for id, telemetry := range telemetries {
+		records[id] = newRecord(telemetry)
+	}
+
+	if err := json.NewEncoder(tmp).Encode(records); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), m.path(snapshotFile)); err != nil {
+		return err
+	}
+
+	wr.Reset(file)
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	m.log.Debugf("saved %d telemetries to snapshot", len(records))
+
+	return nil
+}
+
+func (m *Persister) openLog() (*os.File, error) {
+	// O_APPEND keeps writing at the end of the file after truncation.
+	return os.OpenFile(m.path(logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+func (m *Persister) readSnapshot() ([]*tm.Telemetry, error) {
+	data, err := ioutil.ReadFile(m.path(snapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode telemetry snapshot: %v", err)
+	}
+
+	telemetries := make([]*tm.Telemetry, 0, len(records))
+	for _, record := range records {
+		telemetry, err := record.Telemetry()
+		if err != nil {
+			m.log.Warnf("skipped telemetry snapshot record: %v", err)
+			continue
+		}
+
+		telemetries = append(telemetries, telemetry)
+	}
+
+	return telemetries, nil
+}
+
+func (m *Persister) readLog() ([]*tm.Telemetry, error) {
+	file, err := os.Open(m.path(logFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var telemetries []*tm.Telemetry
+
+	decoder := json.NewDecoder(file)
+	for {
+		record := &record{}
+		if err := decoder.Decode(record); err == io.EOF {
+			break
+		} else if err != nil {
+			// The tail of the log may be torn after a crash.
+			m.log.Warnf("stopped replaying telemetry log: %v", err)
+			break
+		}
+
+		telemetry, err := record.Telemetry()
+		if err != nil {
+			m.log.Warnf("skipped telemetry log record: %v", err)
+			continue
+		}
+
+		telemetries = append(telemetries, telemetry)
+	}
+
+	return telemetries, nil
+}
+
+func (m *Persister) path(name string) string {
+	return filepath.Join(m.cfg.Path, name)
+}
+
+func writeRecord(wr io.Writer, telemetry *tm.Telemetry) error {
+	data, err := json.Marshal(newRecord(telemetry))
+	if err != nil {
+		return err
+	}
+
+	_, err = wr.Write(append(data, '\n'))
+	return err
+}
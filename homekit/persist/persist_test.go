@@ -0,0 +1,145 @@
+package persist
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+func newTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "homekit-persist")
+	require.NoError(t, err)
+
+	return dir
+}
+
+func readAll(storage *tm.TelemetryStorage) map[string]*tm.Telemetry {
+	telemetries := map[string]*tm.Telemetry{}
+	for _, telemetry := range storage.Read(tm.MultiLevelWildcard) {
+		telemetries[telemetry.Key()] = telemetry
+	}
+
+	return telemetries
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{Path: dir, Interval: time.Hour}
+	timestamp := time.Unix(1560000000, 0).UTC()
+
+	labeled := &tm.Telemetry{Topic: "/home/temp", Value: tm.Float(21.5), Labels: tm.Labels{"room": "kitchen"}, Timestamp: timestamp}
+	storage := tm.NewTelemetryStorage()
+	storage.PutMulti([]*tm.Telemetry{
+		labeled,
+		{Topic: "/home/counter", Value: tm.Int(1 << 60), Timestamp: timestamp},
+		{Topic: "/home/door", Value: tm.Bool(true), Timestamp: timestamp},
+		{Topic: "/home/firmware", Value: tm.String("v1.2"), Timestamp: timestamp},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	persister := NewPersister(cfg, storage, zap.NewNop().Sugar())
+	require.NoError(t, persister.Restore())
+	assert.Equal(t, context.Canceled, persister.Run(ctx))
+
+	var topics []string
+	for _, telemetry := range metrics.Default.Collect(time.Now()) {
+		topics = append(topics, telemetry.Topic)
+	}
+	assert.Contains(t, topics, metrics.Prefix+"/persist/dropped")
+
+	restored := tm.NewTelemetryStorage()
+	require.NoError(t, NewPersister(cfg, restored, zap.NewNop().Sugar()).Restore())
+
+	telemetries := readAll(restored)
+	require.Len(t, telemetries, 4)
+	assert.Equal(t, tm.Float(21.5), telemetries[labeled.Key()].Value)
+	assert.Equal(t, tm.Labels{"room": "kitchen"}, telemetries[labeled.Key()].Labels)
+	assert.Equal(t, tm.Int(1<<60), telemetries["/home/counter"].Value)
+	assert.Equal(t, tm.Bool(true), telemetries["/home/door"].Value)
+	assert.Equal(t, tm.String("v1.2"), telemetries["/home/firmware"].Value)
+	assert.True(t, timestamp.Equal(telemetries["/home/door"].Timestamp))
+}
+
+func TestLogReplay(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{Path: dir, Interval: time.Hour}
+	storage := tm.NewTelemetryStorage()
+	persister := NewPersister(cfg, storage, zap.NewNop().Sugar())
+	require.NoError(t, persister.Restore())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- persister.Run(ctx)
+	}()
+
+	// Wait for the subscription to be established.
+	logPath := filepath.Join(dir, logFile)
+	waitFor(t, func() bool {
+		_, err := os.Stat(logPath)
+		return err == nil
+	})
+
+	storage.PutMulti([]*tm.Telemetry{tm.NewTelemetry("/home/temp", tm.Float(20))})
+	storage.PutMulti([]*tm.Telemetry{tm.NewTelemetry("/home/temp", tm.Float(21))})
+
+	waitFor(t, func() bool {
+		data, err := ioutil.ReadFile(logPath)
+		return err == nil && len(data) > 0 && data[len(data)-1] == '\n' && countLines(data) == 2
+	})
+
+	// Simulate a crash with a torn record at the tail.
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"topic":"/home/te`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	restored := tm.NewTelemetryStorage()
+	require.NoError(t, NewPersister(cfg, restored, zap.NewNop().Sugar()).Restore())
+
+	telemetries := readAll(restored)
+	require.Len(t, telemetries, 1)
+	assert.Equal(t, tm.Float(21), telemetries["/home/temp"].Value)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func countLines(data []byte) int {
+	count := 0
+	for _, b := range data {
+		if b == '\n' {
+			count++
+		}
+	}
+
+	return count
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met in time")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,84 @@
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"homekit-ng/homekit/tm"
+)
+
+// record is an on-disk representation of the telemetry, which keeps the
+// value kind to round-trip integers and floats exactly.
+type record struct {
+	Topic     string          `json:"topic"`
+	Labels    tm.Labels       `json:"labels,omitempty"`
+	Kind      string          `json:"kind"`
+	Value     json.RawMessage `json:"value"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+func newRecord(telemetry *tm.Telemetry) *record {
+	// Marshaling native bool, int64, float64 and string never fails, except
+	// for NaN and infinities, which are kept as null.
+	value, err := json.Marshal(telemetry.Value.Interface())
+	if err != nil {
+		value = json.RawMessage("null")
+	}
+
+	return &record{
+		Topic:     telemetry.Topic,
+		Labels:    telemetry.Labels,
+		Kind:      telemetry.Value.Kind().String(),
+		Value:     value,
+		Timestamp: telemetry.Timestamp,
+	}
+}
+
+func (m *record) Telemetry() (*tm.Telemetry, error) {
+	value, err := m.value()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value of %s: %v", m.Kind, m.Topic, err)
+	}
+
+	return &tm.Telemetry{
+		Topic:     m.Topic,
+		Labels:    m.Labels,
+		Value:     value,
+		Timestamp: m.Timestamp,
+	}, nil
+}
+
+func (m *record) value() (tm.TelemetryValue, error) {
+	switch m.Kind {
+	case tm.KindFloat.String():
+		var v *float64
+		if err := json.Unmarshal(m.Value, &v); err != nil {
+			return tm.TelemetryValue{}, err
+		}
+		if v == nil {
+			return tm.TelemetryValue{}, fmt.Errorf("non-finite value is not persisted")
+		}
+		return tm.Float(*v), nil
+	case tm.KindInt.String():
+		var v int64
+		if err := json.Unmarshal(m.Value, &v); err != nil {
+			return tm.TelemetryValue{}, err
+		}
+		return tm.Int(v), nil
+	case tm.KindBool.String():
+		var v bool
+		if err := json.Unmarshal(m.Value, &v); err != nil {
+			return tm.TelemetryValue{}, err
+		}
+		return tm.Bool(v), nil
+	case tm.KindString.String():
+		var v string
+		if err := json.Unmarshal(m.Value, &v); err != nil {
+			return tm.TelemetryValue{}, err
+		}
+		return tm.String(v), nil
+	default:
+		return tm.TelemetryValue{}, fmt.Errorf("unknown kind")
+	}
+}
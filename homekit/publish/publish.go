@@ -3,11 +3,17 @@ package publish
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"time"
 
 	influxdb "github.com/influxdata/influxdb1-client/v2"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 
+	"homekit-ng/homekit/aggregate"
+	"homekit-ng/homekit/metrics"
 	"homekit-ng/homekit/tm"
 )
 
@@ -16,23 +22,61 @@ type InfluxConfig struct {
 	Username string
 	Password string
 	Interval time.Duration
+	// Topics is an MQTT-style pattern of topics to be published.
+	//
+	// All topics are published by default.
+	Topics string
+	// IncludeStale enables publishing stale telemetry, which is skipped
+	// by default.
+	IncludeStale bool `yaml:"include_stale"`
+	// Aggregate enables publishing per-topic aggregates over each publish
+	// interval in addition to the latest values.
+	Aggregate []*aggregate.Config
+}
+
+func (m *InfluxConfig) topics() string {
+	if len(m.Topics) == 0 {
+		return tm.MultiLevelWildcard
+	}
+
+	return m.Topics
+}
+
+type influxMetrics struct {
+	pushes      *metrics.Counter
+	errors      *metrics.Counter
+	points      *metrics.Counter
+	pushSeconds *metrics.Gauge
 }
 
 type InfluxDBMetricsWriter struct {
-	cfg       *InfluxConfig
-	telemetry *tm.TelemetryStorage
-	log       *zap.SugaredLogger
+	cfg        *InfluxConfig
+	telemetry  *tm.TelemetryStorage
+	aggregator *aggregate.Aggregator
+	metrics    *influxMetrics
+	log        *zap.SugaredLogger
 }
 
 func NewInfluxDBMetricsWriter(cfg *InfluxConfig, telemetry *tm.TelemetryStorage, log *zap.SugaredLogger) *InfluxDBMetricsWriter {
 	return &InfluxDBMetricsWriter{
 		cfg:       cfg,
 		telemetry: telemetry,
-		log:       log,
+		metrics: &influxMetrics{
+			pushes:      metrics.NewCounter("influx/pushes", nil),
+			errors:      metrics.NewCounter("influx/errors", nil),
+			points:      metrics.NewCounter("influx/points", nil),
+			pushSeconds: metrics.NewGauge("influx/push_seconds", nil),
+		},
+		log: log,
 	}
 }
 
 func (m *InfluxDBMetricsWriter) Run(ctx context.Context) error {
+	topics, err := tm.CompilePattern(m.cfg.topics())
+	if err != nil {
+		return err
+	}
+
 	influx, err := influxdb.NewHTTPClient(influxdb.HTTPConfig{
 		Addr:     m.cfg.Addr,
 		Username: m.cfg.Username,
@@ -48,31 +92,51 @@ func (m *InfluxDBMetricsWriter) Run(ctx context.Context) error {
 		}
 	}()
 
-	timer := time.NewTicker(m.cfg.Interval)
-	defer timer.Stop()
+	aggregator, err := aggregate.NewAggregator(m.cfg.Aggregate, m.telemetry)
+	if err != nil {
+		return err
+	}
+	m.aggregator = aggregator
+
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		return aggregator.Run(ctx)
+	})
+	wg.Go(func() error {
+		timer := time.NewTicker(m.cfg.Interval)
+		defer timer.Stop()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-timer.C:
-			if err := m.push(ctx, influx); err != nil {
-				m.log.Warnw("failed to push telemetry", zap.Error(err))
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+				startedAt := time.Now()
+				err := m.push(ctx, influx, topics)
+				m.metrics.pushes.Inc()
+				m.metrics.pushSeconds.Set(time.Since(startedAt).Seconds())
+
+				if err != nil {
+					m.metrics.errors.Inc()
+					m.log.Warnw("failed to push telemetry", zap.Error(err))
+				}
 			}
 		}
-	}
+	})
+
+	return wg.Wait()
 }
 
-func (m *InfluxDBMetricsWriter) push(ctx context.Context, influx influxdb.Client) error {
-	fields := map[string]interface{}{}
-	for _, telemetry := range m.telemetry.Read("/") {
-		fields[telemetry.Topic] = telemetry.Value
-	}
+func (m *InfluxDBMetricsWriter) push(ctx context.Context, influx influxdb.Client, topics *tm.Pattern) error {
+	now := time.Now()
 
-	point, err := influxdb.NewPoint("metrics", map[string]string{}, fields, time.Now())
-	if err != nil {
-		return fmt.Errorf("failed to create InfluxDB point: %v", err)
+	telemetries := m.telemetry.ReadPattern(topics)
+	if !m.cfg.IncludeStale {
+		telemetries = m.telemetry.Fresh(telemetries, now)
 	}
+	telemetries = append(telemetries, m.aggregator.Flush()...)
+
+	pointVec := m.newPoints(telemetries, now)
 
 	pointsConfig := influxdb.BatchPointsConfig{
 		Precision:        "s",
@@ -84,13 +148,123 @@ func (m *InfluxDBMetricsWriter) push(ctx context.Context, influx influxdb.Client
 	if err != nil {
 		return fmt.Errorf("failed to create InfluxDB telemetry: %v", err)
 	}
-	points.AddPoint(point)
+	points.AddPoints(pointVec)
 
 	if err := influx.Write(points); err != nil {
-		return fmt.Errorf("failed to write InfluxDB points: %v", err)
+		// InfluxDB writes the valid points of a partial write, like the ones
+		// with conflicting field types, so retrying the batch is pointless.
+		if !strings.Contains(err.Error(), "partial write") {
+			return fmt.Errorf("failed to write InfluxDB points: %v", err)
+		}
+
+		m.metrics.errors.Inc()
+		m.log.Warnf("failed to write some InfluxDB points: %v", err)
 	}
+	m.metrics.points.Add(uint64(len(pointVec)))
+	m.aggregator.Commit()
 
 	m.log.Debugf("pushed metrics to InfluxDB")
 
 	return nil
 }
+
+// newPoints collapses the given telemetries into points, one per distinct
+// label set and timestamp. Labels become point tags, while each topic
+// becomes a field with the native type of its value.
+//
+// Points carry the telemetry timestamps, which may come from sensors, in
+// seconds, while telemetry without a timestamp, like aggregates, is stamped
+// with the given time.
+//
+// Fields InfluxDB would reject, like non-finite floats or fields of a type
+// different from the first one of the same topic, are dropped, so a single
+// bad value does not block the rest of the batch.
+func (m *InfluxDBMetricsWriter) newPoints(telemetries []*tm.Telemetry, now time.Time) []*influxdb.Point {
+	type group struct {
+		labels    string
+		timestamp time.Time
+		tags      map[string]string
+		fields    map[string]interface{}
+	}
+
+	type groupKey struct {
+		labels    string
+		timestamp int64
+	}
+
+	var groups []*group
+	groupsByKey := map[groupKey]*group{}
+	kinds := map[tm.Topic]tm.Kind{}
+	for _, telemetry := range telemetries {
+		if err := validateField(telemetry, kinds); err != nil {
+			m.metrics.errors.Inc()
+			m.log.Warnf("dropped InfluxDB field %s: %v", telemetry.Key(), err)
+			continue
+		}
+
+		timestamp := telemetry.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+		timestamp = timestamp.Truncate(time.Second)
+
+		key := groupKey{labels: telemetry.Labels.String(), timestamp: timestamp.Unix()}
+
+		g, ok := groupsByKey[key]
+		if !ok {
+			tags := map[string]string{}
+			for k, v := range telemetry.Labels {
+				tags[k] = v
+			}
+
+			g = &group{labels: key.labels, timestamp: timestamp, tags: tags, fields: map[string]interface{}{}}
+			groupsByKey[key] = g
+			groups = append(groups, g)
+		}
+
+		g.fields[telemetry.Topic] = telemetry.Value.Interface()
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].labels != groups[j].labels {
+			return groups[i].labels < groups[j].labels
+		}
+
+		return groups[i].timestamp.Before(groups[j].timestamp)
+	})
+
+	var points []*influxdb.Point
+	for _, g := range groups {
+		point, err := influxdb.NewPoint("metrics", g.tags, g.fields, g.timestamp)
+		if err != nil {
+			m.metrics.errors.Inc()
+			m.log.Warnf("dropped InfluxDB point %s: %v", g.labels, err)
+			continue
+		}
+
+		points = append(points, point)
+	}
+
+	return points
+}
+
+// validateField checks that InfluxDB accepts the value of the telemetry,
+// remembering the kind of the first value of each topic.
+func validateField(telemetry *tm.Telemetry, kinds map[tm.Topic]tm.Kind) error {
+	if telemetry.Value.Kind() == tm.KindFloat {
+		if v := telemetry.Value.Float(); math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("non-finite value %v", v)
+		}
+	}
+
+	kind, ok := kinds[telemetry.Topic]
+	if !ok {
+		kinds[telemetry.Topic] = telemetry.Value.Kind()
+		return nil
+	}
+	if kind != telemetry.Value.Kind() {
+		return fmt.Errorf("field type conflict: %s, expected %s", telemetry.Value.Kind(), kind)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package publish
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"homekit-ng/homekit/metrics"
+	"homekit-ng/homekit/tm"
+)
+
+var testNow = time.Unix(1560000000, 0)
+
+func newTelemetry(topic tm.Topic, value tm.TelemetryValue) *tm.Telemetry {
+	telemetry := tm.NewTelemetry(topic, value)
+	telemetry.Timestamp = testNow
+
+	return telemetry
+}
+
+func newTestWriter() *InfluxDBMetricsWriter {
+	return &InfluxDBMetricsWriter{
+		metrics: &influxMetrics{errors: &metrics.Counter{}},
+		log:     zap.NewNop().Sugar(),
+	}
+}
+
+func TestNewPointNativeFieldTypes(t *testing.T) {
+	telemetries := []*tm.Telemetry{
+		newTelemetry("/home/temp", tm.Float(21.5)),
+		newTelemetry("/home/counter", tm.Int(42)),
+		newTelemetry("/home/door", tm.Bool(true)),
+		newTelemetry("/home/firmware", tm.String("v1.2")),
+	}
+
+	points := newTestWriter().newPoints(telemetries, testNow)
+	require.Len(t, points, 1)
+
+	fields, err := points[0].Fields()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"/home/temp":     21.5,
+		"/home/counter":  int64(42),
+		"/home/door":     true,
+		"/home/firmware": "v1.2",
+	}, fields)
+}
+
+func TestNewPointsLabelsAsTags(t *testing.T) {
+	kitchen := newTelemetry("/home/temp", tm.Float(21.5))
+	kitchen.Labels = tm.Labels{"room": "kitchen"}
+	bathroom := newTelemetry("/home/temp", tm.Float(25))
+	bathroom.Labels = tm.Labels{"room": "bathroom"}
+	bathroomHumidity := newTelemetry("/home/humidity", tm.Float(70))
+	bathroomHumidity.Labels = tm.Labels{"room": "bathroom"}
+
+	telemetries := []*tm.Telemetry{
+		kitchen,
+		bathroom,
+		bathroomHumidity,
+		newTelemetry("/home/activity", tm.Float(1)),
+	}
+
+	points := newTestWriter().newPoints(telemetries, testNow)
+	require.Len(t, points, 3)
+
+	assert.Empty(t, points[0].Tags())
+	assert.Equal(t, map[string]string{"room": "bathroom"}, points[1].Tags())
+	assert.Equal(t, map[string]string{"room": "kitchen"}, points[2].Tags())
+
+	fields, err := points[1].Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"/home/temp": 25.0, "/home/humidity": 70.0}, fields)
+}
+
+func TestNewPointsDropsInvalidFields(t *testing.T) {
+	kitchen := newTelemetry("/home/temp", tm.Int(21))
+	kitchen.Labels = tm.Labels{"room": "kitchen"}
+
+	telemetries := []*tm.Telemetry{
+		newTelemetry("/home/temp", tm.Float(21.5)),
+		newTelemetry("/home/dewpoint", tm.Float(math.NaN())),
+		newTelemetry("/home/power", tm.Float(math.Inf(1))),
+		kitchen,
+		newTelemetry("/home/humidity", tm.Float(40)),
+	}
+
+	writer := newTestWriter()
+	points := writer.newPoints(telemetries, testNow)
+	require.Len(t, points, 1)
+	assert.Equal(t, uint64(3), writer.metrics.errors.Value())
+
+	fields, err := points[0].Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"/home/temp": 21.5, "/home/humidity": 40.0}, fields)
+}
+
+func TestNewPointsTimestamps(t *testing.T) {
+	buffered := newTelemetry("/home/temp", tm.Float(20))
+	buffered.Timestamp = testNow.Add(-time.Hour)
+	aggregated := newTelemetry("/home/temp_max", tm.Float(22))
+	aggregated.Timestamp = time.Time{}
+
+	telemetries := []*tm.Telemetry{
+		buffered,
+		newTelemetry("/home/humidity", tm.Float(40)),
+		aggregated,
+	}
+
+	points := newTestWriter().newPoints(telemetries, testNow)
+	require.Len(t, points, 2)
+
+	// Sensor timestamps are kept, while aggregates are stamped with the
+	// push time.
+	assert.Equal(t, testNow.Add(-time.Hour), points[0].Time())
+	fields, err := points[0].Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"/home/temp": 20.0}, fields)
+
+	assert.Equal(t, testNow, points[1].Time())
+	fields, err = points[1].Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"/home/humidity": 40.0, "/home/temp_max": 22.0}, fields)
+}
@@ -0,0 +1,116 @@
+package tm
+
+import (
+	"time"
+)
+
+// HistoryConfig describes how much of the telemetry history is kept in
+// memory for each topic.
+//
+// Both limits may be combined. A zero value disables the corresponding
+// limit, while a zero config disables the history entirely.
+type HistoryConfig struct {
+	// Size is the maximum number of samples kept per topic.
+	Size int
+	// MaxAge is the maximum age of a sample. Older samples are dropped.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (m *HistoryConfig) enabled() bool {
+	return m.Size > 0 || m.MaxAge > 0
+}
+
+// history is a bounded ring buffer of samples of a single topic, ordered by
+// timestamp.
+//
+// Samples usually arrive in order, but sensors flushing their buffers send
+// backdated ones, which are inserted before newer samples.
+type history struct {
+	samples []*Telemetry
+	head    int
+	len     int
+}
+
+func newHistory(cfg *HistoryConfig) *history {
+	capacity := cfg.Size
+	if capacity <= 0 {
+		// Age-only history grows on demand.
+		capacity = 16
+	}
+
+	return &history{
+		samples: make([]*Telemetry, capacity),
+	}
+}
+
+func (m *history) push(cfg *HistoryConfig, telemetry *Telemetry) {
+	pos := m.len
+	for pos > 0 && m.at(pos-1).Timestamp.After(telemetry.Timestamp) {
+		pos--
+	}
+
+	if m.len == len(m.samples) {
+		if cfg.Size > 0 {
+			// Full fixed-size ring, drop the oldest sample, which may be
+			// the given one.
+			if pos == 0 {
+				return
+			}
+
+			m.samples[m.head] = nil
+			m.head = (m.head + 1) % len(m.samples)
+			m.len--
+			pos--
+		} else {
+			m.grow()
+		}
+	}
+
+	for id := m.len; id > pos; id-- {
+		m.set(id, m.at(id-1))
+	}
+	m.set(pos, telemetry)
+	m.len++
+}
+
+func (m *history) grow() {
+	samples := make([]*Telemetry, 2*len(m.samples))
+	for id := 0; id < m.len; id++ {
+		samples[id] = m.at(id)
+	}
+
+	m.samples = samples
+	m.head = 0
+}
+
+func (m *history) at(id int) *Telemetry {
+	return m.samples[(m.head+id)%len(m.samples)]
+}
+
+func (m *history) set(id int, telemetry *Telemetry) {
+	m.samples[(m.head+id)%len(m.samples)] = telemetry
+}
+
+// expire drops samples with timestamps before the given deadline.
+func (m *history) expire(deadline time.Time) {
+	for m.len > 0 && m.at(0).Timestamp.Before(deadline) {
+		m.samples[m.head] = nil
+		m.head = (m.head + 1) % len(m.samples)
+		m.len--
+	}
+}
+
+// collect returns samples within [from, to] ordered by their timestamp.
+func (m *history) collect(from, to time.Time) []*Telemetry {
+	var samples []*Telemetry
+	for id := 0; id < m.len; id++ {
+		sample := m.at(id)
+		if sample.Timestamp.Before(from) || sample.Timestamp.After(to) {
+			continue
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples
+}
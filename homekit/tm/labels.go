@@ -0,0 +1,89 @@
+package tm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels is a set of key-value pairs describing the telemetry source, like
+// a room, a sensor id or a device kind.
+type Labels map[string]string
+
+// String returns the canonical representation of labels, i.e.
+// "{a=b,c=d}" with keys sorted, or an empty string if there are no labels.
+func (m Labels) String() string {
+	if len(m) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for id, key := range keys {
+		pairs[id] = key + "=" + m[key]
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ParseSeries parses a topic with an optional label set, like
+// "/home/temp{room=kitchen,sensor=a1}".
+func ParseSeries(v string) (Topic, Labels, error) {
+	open := strings.IndexByte(v, '{')
+	if open < 0 {
+		if strings.ContainsAny(v, "}") {
+			return "", nil, fmt.Errorf("unexpected '}' in topic %q", v)
+		}
+		return v, nil, nil
+	}
+
+	if !strings.HasSuffix(v, "}") {
+		return "", nil, fmt.Errorf("labels must be terminated with '}' in %q", v)
+	}
+
+	topic := v[:open]
+	if len(topic) == 0 {
+		return "", nil, fmt.Errorf("empty topic in %q", v)
+	}
+
+	labels, err := ParseLabels(v[open+1 : len(v)-1])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid labels in %q: %v", v, err)
+	}
+
+	return topic, labels, nil
+}
+
+// ParseLabels parses comma-separated label pairs without braces, like
+// "room=kitchen,sensor=a1".
+func ParseLabels(v string) (Labels, error) {
+	labels := Labels{}
+	if len(strings.TrimSpace(v)) == 0 {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label pair: %s", pair)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty label key: %s", pair)
+		}
+		if strings.ContainsAny(key+value, "{}") {
+			return nil, fmt.Errorf("unexpected brace in label pair: %s", pair)
+		}
+
+		labels[key] = value
+	}
+
+	return labels, nil
+}
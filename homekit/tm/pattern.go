@@ -0,0 +1,116 @@
+package tm
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// TopicSeparator separates topic levels.
+	TopicSeparator = "/"
+	// SingleLevelWildcard matches exactly one topic level.
+	SingleLevelWildcard = "+"
+	// MultiLevelWildcard matches any number of trailing topic levels,
+	// including the parent level itself. Must be the last level of a
+	// pattern.
+	MultiLevelWildcard = "#"
+)
+
+// ValidatePattern checks that the given MQTT-style topic pattern is
+// well-formed, i.e. wildcards occupy entire levels and "#" appears only as
+// the last level.
+func ValidatePattern(pattern string) error {
+	if len(pattern) == 0 {
+		return fmt.Errorf("empty topic pattern")
+	}
+
+	levels := strings.Split(pattern, TopicSeparator)
+	for id, level := range levels {
+		switch {
+		case level == MultiLevelWildcard:
+			if id != len(levels)-1 {
+				return fmt.Errorf("invalid topic pattern %q: %q must be the last level", pattern, MultiLevelWildcard)
+			}
+		case level == SingleLevelWildcard:
+		case strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard):
+			return fmt.Errorf("invalid topic pattern %q: wildcard must occupy an entire level", pattern)
+		}
+	}
+
+	return nil
+}
+
+// Pattern is a compiled MQTT-style topic pattern.
+//
+// Matching is done level by level, where "+" matches exactly one level and
+// "#" matches the rest of the topic. A pattern without wildcards matches
+// only the same topic.
+type Pattern struct {
+	pattern string
+	levels  []string
+}
+
+// CompilePattern validates and compiles the given topic pattern.
+func CompilePattern(pattern string) (*Pattern, error) {
+	if err := ValidatePattern(pattern); err != nil {
+		return nil, err
+	}
+
+	return &Pattern{
+		pattern: pattern,
+		levels:  strings.Split(pattern, TopicSeparator),
+	}, nil
+}
+
+// MustCompilePattern is like CompilePattern, but panics on malformed
+// patterns.
+func MustCompilePattern(pattern string) *Pattern {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+func (m *Pattern) String() string {
+	return m.pattern
+}
+
+// Match reports whether the topic matches the pattern.
+func (m *Pattern) Match(topic Topic) bool {
+	levels := strings.Split(topic, TopicSeparator)
+
+	for id, level := range m.levels {
+		if level == MultiLevelWildcard {
+			return true
+		}
+
+		if id >= len(levels) {
+			return false
+		}
+
+		if level != SingleLevelWildcard && level != levels[id] {
+			return false
+		}
+	}
+
+	return len(m.levels) == len(levels)
+}
+
+// Match reports whether the topic matches the given MQTT-style pattern.
+//
+// Malformed patterns match nothing.
+func Match(pattern string, topic Topic) bool {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		return false
+	}
+
+	return p.Match(topic)
+}
+
+// IsWildcard reports whether the pattern contains any wildcards.
+func IsWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, SingleLevelWildcard+MultiLevelWildcard)
+}
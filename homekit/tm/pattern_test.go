@@ -0,0 +1,44 @@
+package tm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"/home/temp", "/home/temp", true},
+		{"/home/temp", "/home/temperature", false},
+		{"/home/temp", "/home/temp/outdoor", false},
+		{"/home/+", "/home/temp", true},
+		{"/home/+", "/home", false},
+		{"/home/+", "/home/", true},
+		{"/home/+/humidity", "/home/kitchen/humidity", true},
+		{"/home/+/humidity", "/home/kitchen/fan/humidity", false},
+		{"/home/#", "/home", true},
+		{"/home/#", "/home/kitchen/fan/humidity", true},
+		{"/home/#", "/homes/kitchen", false},
+		{"#", "/home/temp", true},
+		{"+/home/temp", "/home/temp", true},
+		{"/home/#/temp", "/home/kitchen/temp", false},
+		{"/home/te+", "/home/temp", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.match, Match(test.pattern, test.topic), "%s ~ %s", test.pattern, test.topic)
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	assert.NoError(t, ValidatePattern("/home/+/humidity"))
+	assert.NoError(t, ValidatePattern("/home/#"))
+	assert.Error(t, ValidatePattern(""))
+	assert.Error(t, ValidatePattern("/home/#/humidity"))
+	assert.Error(t, ValidatePattern("/home/temp#"))
+	assert.Error(t, ValidatePattern("/home/+temp"))
+}
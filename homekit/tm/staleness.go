@@ -0,0 +1,120 @@
+package tm
+
+import (
+	"time"
+)
+
+// StalenessConfig describes when telemetry is considered stale, i.e. when
+// its source stopped reporting.
+type StalenessConfig struct {
+	// MaxAge is the default maximum age of the telemetry.
+	//
+	// Zero means that telemetry never becomes stale.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Rules override the maximum age for topics matching their patterns.
+	//
+	// The first matching rule wins.
+	Rules []*StalenessRule
+	// Evict enables removing stale telemetry from the storage.
+	Evict bool
+}
+
+type StalenessRule struct {
+	// Pattern is an MQTT-style topic pattern.
+	Pattern string
+	// MaxAge is the maximum age of matching telemetry. Zero means that
+	// matching telemetry never becomes stale.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type staleness struct {
+	maxAge time.Duration
+	rules  []*compiledStalenessRule
+}
+
+type compiledStalenessRule struct {
+	pattern *Pattern
+	maxAge  time.Duration
+}
+
+func newStaleness(cfg *StalenessConfig) (*staleness, error) {
+	rules := make([]*compiledStalenessRule, len(cfg.Rules))
+	for id, rule := range cfg.Rules {
+		pattern, err := CompilePattern(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		rules[id] = &compiledStalenessRule{
+			pattern: pattern,
+			maxAge:  rule.MaxAge,
+		}
+	}
+
+	return &staleness{
+		maxAge: cfg.MaxAge,
+		rules:  rules,
+	}, nil
+}
+
+func (m *staleness) MaxAge(topic Topic) time.Duration {
+	for _, rule := range m.rules {
+		if rule.pattern.Match(topic) {
+			return rule.maxAge
+		}
+	}
+
+	return m.maxAge
+}
+
+func (m *staleness) IsStale(telemetry *Telemetry, now time.Time) bool {
+	maxAge := m.MaxAge(telemetry.Topic)
+	if maxAge <= 0 {
+		return false
+	}
+
+	return now.Sub(telemetry.Timestamp) > maxAge
+}
+
+// IsStale reports whether the given telemetry is older than the maximum
+// age configured for its topic.
+func (m *TelemetryStorage) IsStale(telemetry *Telemetry, now time.Time) bool {
+	return m.staleness.IsStale(telemetry, now)
+}
+
+// Fresh filters out stale telemetries.
+func (m *TelemetryStorage) Fresh(telemetries []*Telemetry, now time.Time) []*Telemetry {
+	fresh := make([]*Telemetry, 0, len(telemetries))
+	for _, telemetry := range telemetries {
+		if !m.IsStale(telemetry, now) {
+			fresh = append(fresh, telemetry)
+		}
+	}
+
+	return fresh
+}
+
+// Stale returns the latest telemetry of every stale series.
+func (m *TelemetryStorage) Stale(now time.Time) []*Telemetry {
+	return m.read(func(telemetry *Telemetry) bool {
+		return m.IsStale(telemetry, now)
+	})
+}
+
+// EvictStale removes stale series from the storage, returning them.
+//
+// The history of evicted series is kept until it expires on its own.
+func (m *TelemetryStorage) EvictStale(now time.Time) []*Telemetry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var evicted []*Telemetry
+	for key, telemetry := range m.telemetries {
+		if m.IsStale(telemetry, now) {
+			delete(m.telemetries, key)
+			evicted = append(evicted, telemetry)
+		}
+	}
+
+	return evicted
+}
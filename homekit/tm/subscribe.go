@@ -0,0 +1,201 @@
+package tm
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy describes what happens when a subscriber does not keep up
+// with the incoming telemetry and its buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest buffered telemetry to make room for
+	// the new one.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the new telemetry, keeping the buffer intact.
+	DropNewest
+	// Block waits for the subscriber to make room for up to the configured
+	// timeout, which is required, and discards the telemetry after that.
+	//
+	// Note that blocking subscribers slow down PutMulti callers.
+	Block
+)
+
+func (m OverflowPolicy) String() string {
+	switch m {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+const defaultSubscriptionCapacity = 128
+
+// SubscribeOptions configure a subscription.
+type SubscribeOptions struct {
+	// Capacity is the size of the subscription buffer.
+	//
+	// Defaults to 128.
+	Capacity int
+	// Policy is the slow-consumer policy.
+	Policy OverflowPolicy
+	// Timeout limits how long a delivery may block with the Block policy.
+	//
+	// It must be positive with the Block policy, since every PutMulti caller
+	// waits for the slowest blocking subscriber.
+	Timeout time.Duration
+}
+
+// Subscription delivers every telemetry put into the storage that matches
+// the subscription pattern.
+type Subscription struct {
+	pattern *Pattern
+	opts    SubscribeOptions
+	storage *TelemetryStorage
+
+	mu      sync.Mutex
+	closed  bool
+	txrx    chan *Telemetry
+	done    chan struct{}
+	once    sync.Once
+	dropped uint64
+}
+
+// C returns the channel telemetry is delivered to.
+//
+// The channel is closed after Unsubscribe.
+func (m *Subscription) C() <-chan *Telemetry {
+	return m.txrx
+}
+
+// Dropped returns the number of telemetries discarded due to the overflow
+// policy.
+func (m *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// Unsubscribe cancels the subscription and closes its channel.
+//
+// It is safe to call Unsubscribe multiple times.
+func (m *Subscription) Unsubscribe() {
+	m.once.Do(func() {
+		// Wake up blocked deliveries first, they may hold the storage
+		// subscriptions lock.
+		close(m.done)
+		m.storage.unsubscribe(m)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.closed = true
+		close(m.txrx)
+	})
+}
+
+func (m *Subscription) deliver(telemetry *Telemetry) {
+	if !m.pattern.Match(telemetry.Topic) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.txrx <- telemetry:
+		return
+	default:
+	}
+
+	switch m.opts.Policy {
+	case DropOldest:
+		for {
+			select {
+			case <-m.txrx:
+				atomic.AddUint64(&m.dropped, 1)
+			default:
+			}
+
+			select {
+			case m.txrx <- telemetry:
+				return
+			default:
+			}
+		}
+	case DropNewest:
+		atomic.AddUint64(&m.dropped, 1)
+	case Block:
+		timer := time.NewTimer(m.opts.Timeout)
+		defer timer.Stop()
+
+		select {
+		case m.txrx <- telemetry:
+		case <-m.done:
+		case <-timer.C:
+			atomic.AddUint64(&m.dropped, 1)
+		}
+	}
+}
+
+// Subscribe starts delivering every telemetry put via PutMulti whose topic
+// matches the given MQTT-style pattern.
+//
+// The caller must call Unsubscribe when the subscription is no longer
+// needed.
+func (m *TelemetryStorage) Subscribe(pattern string, opts SubscribeOptions) (*Subscription, error) {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Capacity <= 0 {
+		opts.Capacity = defaultSubscriptionCapacity
+	}
+	if opts.Policy == Block && opts.Timeout <= 0 {
+		return nil, fmt.Errorf("timeout is required for the %s policy", opts.Policy)
+	}
+
+	subscription := &Subscription{
+		pattern: p,
+		opts:    opts,
+		storage: m,
+		txrx:    make(chan *Telemetry, opts.Capacity),
+		done:    make(chan struct{}),
+	}
+
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+
+	m.subscriptions[subscription] = struct{}{}
+
+	return subscription, nil
+}
+
+func (m *TelemetryStorage) unsubscribe(subscription *Subscription) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+
+	delete(m.subscriptions, subscription)
+}
+
+func (m *TelemetryStorage) notify(telemetries []*Telemetry) {
+	m.subsMu.RLock()
+	defer m.subsMu.RUnlock()
+
+	for subscription := range m.subscriptions {
+		for _, telemetry := range telemetries {
+			subscription.deliver(telemetry)
+		}
+	}
+}
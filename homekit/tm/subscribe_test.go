@@ -0,0 +1,135 @@
+package tm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	subscription, err := storage.Subscribe("/home/+/humidity", SubscribeOptions{})
+	require.NoError(t, err)
+	defer subscription.Unsubscribe()
+
+	storage.PutMulti([]*Telemetry{
+		NewTelemetry("/home/kitchen/humidity", Float(40)),
+		NewTelemetry("/home/kitchen/temp", Float(21)),
+		NewTelemetry("/home/bathroom/humidity", Float(70)),
+	})
+
+	assert.Equal(t, "/home/kitchen/humidity", (<-subscription.C()).Topic)
+	assert.Equal(t, "/home/bathroom/humidity", (<-subscription.C()).Topic)
+	assert.Empty(t, subscription.C())
+}
+
+func TestSubscribeInvalidPattern(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	subscription, err := storage.Subscribe("/home/#/humidity", SubscribeOptions{})
+	assert.Error(t, err)
+	assert.Nil(t, subscription)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	subscription, err := storage.Subscribe("#", SubscribeOptions{})
+	require.NoError(t, err)
+
+	subscription.Unsubscribe()
+	subscription.Unsubscribe()
+
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(21))})
+
+	_, ok := <-subscription.C()
+	assert.False(t, ok)
+}
+
+func TestSubscribeDropOldest(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	subscription, err := storage.Subscribe("#", SubscribeOptions{Capacity: 2, Policy: DropOldest})
+	require.NoError(t, err)
+	defer subscription.Unsubscribe()
+
+	for id := 0; id < 5; id++ {
+		storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(float64(id)))})
+	}
+
+	assert.Equal(t, uint64(3), subscription.Dropped())
+	assert.Equal(t, Float(3), (<-subscription.C()).Value)
+	assert.Equal(t, Float(4), (<-subscription.C()).Value)
+}
+
+func TestSubscribeDropNewest(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	subscription, err := storage.Subscribe("#", SubscribeOptions{Capacity: 2, Policy: DropNewest})
+	require.NoError(t, err)
+	defer subscription.Unsubscribe()
+
+	for id := 0; id < 5; id++ {
+		storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(float64(id)))})
+	}
+
+	assert.Equal(t, uint64(3), subscription.Dropped())
+	assert.Equal(t, Float(0), (<-subscription.C()).Value)
+	assert.Equal(t, Float(1), (<-subscription.C()).Value)
+}
+
+func TestSubscribeBlockTimeout(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	subscription, err := storage.Subscribe("#", SubscribeOptions{Capacity: 1, Policy: Block, Timeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer subscription.Unsubscribe()
+
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(0))})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(1))})
+	}()
+
+	assert.Equal(t, Float(0), (<-subscription.C()).Value)
+	assert.Equal(t, Float(1), (<-subscription.C()).Value)
+	<-done
+
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(2))})
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(3))})
+	assert.Equal(t, uint64(1), subscription.Dropped())
+}
+
+func TestSubscribeBlockWithoutTimeout(t *testing.T) {
+	_, err := NewTelemetryStorage().Subscribe("#", SubscribeOptions{Policy: Block})
+	assert.Error(t, err)
+}
+
+func TestUnsubscribeWakesBlockedDelivery(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	subscription, err := storage.Subscribe("#", SubscribeOptions{Capacity: 1, Policy: Block, Timeout: time.Minute})
+	require.NoError(t, err)
+
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(0))})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(1))})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	subscription.Unsubscribe()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("PutMulti is still blocked after unsubscribe")
+	}
+}
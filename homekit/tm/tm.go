@@ -7,11 +7,15 @@ import (
 )
 
 type Topic = string
-type TelemetryValue = float64
 
 type Telemetry struct {
 	Topic Topic
 	Value TelemetryValue
+	// Labels describe the telemetry source, optional.
+	//
+	// Telemetries with the same topic, but different labels are stored as
+	// different series.
+	Labels Labels
 	// Timestamp shows the time when we received the telemetry.
 	//
 	// This value is calculated at the server side to avoid clock skewing.
@@ -26,24 +30,93 @@ func NewTelemetry(topic Topic, value TelemetryValue) *Telemetry {
 	}
 }
 
+// Key returns the series key, which is the topic followed by canonical
+// labels if there are any, e.g. "/home/temp{room=kitchen}".
+func (m *Telemetry) Key() string {
+	return m.Topic + m.Labels.String()
+}
+
+// Config describes the telemetry storage.
+type Config struct {
+	History   HistoryConfig
+	Staleness StalenessConfig
+}
+
 type TelemetryStorage struct {
+	cfg         Config
+	staleness   *staleness
 	mu          sync.RWMutex
-	telemetries map[Topic]*Telemetry
+	telemetries map[string]*Telemetry
+	history     map[string]*history
+	puts        uint64
+
+	subsMu        sync.RWMutex
+	subscriptions map[*Subscription]struct{}
 }
 
 func NewTelemetryStorage() *TelemetryStorage {
-	return &TelemetryStorage{
-		telemetries: map[Topic]*Telemetry{},
+	storage, err := NewTelemetryStorageWithConfig(Config{})
+	if err != nil {
+		// Empty config is always valid.
+		panic(err)
+	}
+
+	return storage
+}
+
+func NewTelemetryStorageWithConfig(cfg Config) (*TelemetryStorage, error) {
+	staleness, err := newStaleness(&cfg.Staleness)
+	if err != nil {
+		return nil, err
 	}
+
+	storage := &TelemetryStorage{
+		cfg:         cfg,
+		staleness:   staleness,
+		telemetries: map[string]*Telemetry{},
+		history:     map[string]*history{},
+
+		subscriptions: map[*Subscription]struct{}{},
+	}
+
+	return storage, nil
 }
 
-func (m *TelemetryStorage) Read(topic string) []*Telemetry {
+// Read returns the latest telemetry of every series whose topic matches the
+// given MQTT-style pattern, see Pattern.
+//
+// Malformed patterns match nothing.
+func (m *TelemetryStorage) Read(pattern string) []*Telemetry {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		return nil
+	}
+
+	return m.ReadPattern(p)
+}
+
+// ReadPattern is like Read, but accepts a precompiled pattern.
+func (m *TelemetryStorage) ReadPattern(pattern *Pattern) []*Telemetry {
+	return m.read(func(telemetry *Telemetry) bool {
+		return pattern.Match(telemetry.Topic)
+	})
+}
+
+// ReadPrefix returns the latest telemetry of every series whose topic starts
+// with the given prefix, regardless of topic levels.
+func (m *TelemetryStorage) ReadPrefix(prefix string) []*Telemetry {
+	return m.read(func(telemetry *Telemetry) bool {
+		return strings.HasPrefix(telemetry.Topic, prefix)
+	})
+}
+
+func (m *TelemetryStorage) read(match func(telemetry *Telemetry) bool) []*Telemetry {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	var telemetries []*Telemetry
-	for key, telemetry := range m.telemetries {
-		if strings.HasPrefix(key, topic) {
+	for _, telemetry := range m.telemetries {
+		if match(telemetry) {
 			telemetries = append(telemetries, telemetry)
 		}
 	}
@@ -51,11 +124,92 @@ func (m *TelemetryStorage) Read(topic string) []*Telemetry {
 	return telemetries
 }
 
+// Range returns the history samples of the given series with timestamps
+// within [from, to], ordered by timestamp.
+//
+// The series is identified by its key, see Telemetry.Key, which is just the
+// topic for telemetries without labels.
+//
+// Returns nothing if the history is disabled.
+func (m *TelemetryStorage) Range(key string, from, to time.Time) []*Telemetry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history, ok := m.history[key]
+	if !ok {
+		return nil
+	}
+
+	m.expire(key, history)
+
+	return history.collect(from, to)
+}
+
+// PutMulti stores the given telemetries and notifies subscribers.
 func (m *TelemetryStorage) PutMulti(telemetries []*Telemetry) {
+	m.put(telemetries)
+	m.notify(telemetries)
+}
+
+func (m *TelemetryStorage) put(telemetries []*Telemetry) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	for _, telemetry := range telemetries {
-		m.telemetries[telemetry.Topic] = telemetry
+		key := telemetry.Key()
+
+		// Backdated samples, like the ones flushed from sensor buffers, only
+		// go into the history, keeping the latest value the newest one.
+		if existing, ok := m.telemetries[key]; !ok || !telemetry.Timestamp.Before(existing.Timestamp) {
+			m.telemetries[key] = telemetry
+		}
+		m.record(telemetry)
+	}
+	m.puts += uint64(len(telemetries))
+}
+
+// Stats describes the storage usage.
+type Stats struct {
+	// Puts is the total number of telemetry values put.
+	Puts uint64
+	// Series is the number of distinct series.
+	Series int
+}
+
+func (m *TelemetryStorage) Stats() Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return Stats{
+		Puts:   m.puts,
+		Series: len(m.telemetries),
+	}
+}
+
+func (m *TelemetryStorage) record(telemetry *Telemetry) {
+	if !m.cfg.History.enabled() {
+		return
+	}
+
+	key := telemetry.Key()
+
+	h, ok := m.history[key]
+	if !ok {
+		h = newHistory(&m.cfg.History)
+		m.history[key] = h
+	}
+
+	h.push(&m.cfg.History, telemetry)
+	m.expire(key, h)
+}
+
+func (m *TelemetryStorage) expire(key string, h *history) {
+	if m.cfg.History.MaxAge <= 0 {
+		return
+	}
+
+	h.expire(time.Now().Add(-m.cfg.History.MaxAge))
+	if h.len == 0 {
+		delete(m.history, key)
 	}
 }
@@ -0,0 +1,258 @@
+package tm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTelemetryAt(topic Topic, value TelemetryValue, timestamp time.Time) *Telemetry {
+	return &Telemetry{
+		Topic:     topic,
+		Value:     value,
+		Timestamp: timestamp,
+	}
+}
+
+func newTelemetryStorage(t *testing.T, cfg Config) *TelemetryStorage {
+	storage, err := NewTelemetryStorageWithConfig(cfg)
+	require.NoError(t, err)
+
+	return storage
+}
+
+func TestRangeHistoryDisabled(t *testing.T) {
+	storage := NewTelemetryStorage()
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(21.5))})
+
+	assert.Empty(t, storage.Range("/home/temp", time.Time{}, time.Now()))
+	assert.Len(t, storage.Read("/home/temp"), 1)
+}
+
+func TestRangeOrderedByTimestamp(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{Size: 8}})
+
+	now := time.Now()
+	storage.PutMulti([]*Telemetry{
+		newTelemetryAt("/home/temp", Float(3), now.Add(-1*time.Minute)),
+		newTelemetryAt("/home/temp", Float(1), now.Add(-3*time.Minute)),
+		newTelemetryAt("/home/temp", Float(2), now.Add(-2*time.Minute)),
+		newTelemetryAt("/home/humidity", Float(40), now),
+	})
+
+	samples := storage.Range("/home/temp", now.Add(-time.Hour), now)
+	require.Len(t, samples, 3)
+	assert.Equal(t, Float(1), samples[0].Value)
+	assert.Equal(t, Float(2), samples[1].Value)
+	assert.Equal(t, Float(3), samples[2].Value)
+}
+
+func TestRangeBounds(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{Size: 8}})
+
+	now := time.Now()
+	for id := 0; id < 5; id++ {
+		storage.PutMulti([]*Telemetry{
+			newTelemetryAt("/home/temp", Float(float64(id)), now.Add(time.Duration(id-5)*time.Minute)),
+		})
+	}
+
+	samples := storage.Range("/home/temp", now.Add(-4*time.Minute), now.Add(-2*time.Minute))
+	require.Len(t, samples, 3)
+	assert.Equal(t, Float(1), samples[0].Value)
+	assert.Equal(t, Float(3), samples[2].Value)
+}
+
+func TestRangeSizeLimit(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{Size: 3}})
+
+	now := time.Now()
+	for id := 0; id < 10; id++ {
+		storage.PutMulti([]*Telemetry{
+			newTelemetryAt("/home/temp", Float(float64(id)), now.Add(time.Duration(id)*time.Second)),
+		})
+	}
+
+	samples := storage.Range("/home/temp", now, now.Add(time.Minute))
+	require.Len(t, samples, 3)
+	assert.Equal(t, Float(7), samples[0].Value)
+	assert.Equal(t, Float(9), samples[2].Value)
+
+	// The latest value is unaffected by the history.
+	telemetries := storage.Read("/home/temp")
+	require.Len(t, telemetries, 1)
+	assert.Equal(t, Float(9), telemetries[0].Value)
+}
+
+func TestRangeSizeLimitBackdated(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{Size: 3}})
+
+	now := time.Now()
+	for _, offset := range []int{5, 6, 7, 1, 8} {
+		storage.PutMulti([]*Telemetry{
+			newTelemetryAt("/home/temp", Float(float64(offset)), now.Add(time.Duration(offset)*time.Second)),
+		})
+	}
+
+	// The backdated sample is the oldest one, so it is dropped first.
+	samples := storage.Range("/home/temp", now, now.Add(time.Minute))
+	require.Len(t, samples, 3)
+	assert.Equal(t, Float(6), samples[0].Value)
+	assert.Equal(t, Float(7), samples[1].Value)
+	assert.Equal(t, Float(8), samples[2].Value)
+}
+
+func TestRangeMaxAgeBackdated(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{MaxAge: 10 * time.Minute}})
+
+	now := time.Now()
+	storage.PutMulti([]*Telemetry{
+		newTelemetryAt("/home/temp", Float(1), now.Add(-time.Minute)),
+		newTelemetryAt("/home/temp", Float(2), now.Add(-time.Hour)),
+		newTelemetryAt("/home/temp", Float(3), now.Add(-5*time.Minute)),
+	})
+
+	samples := storage.Range("/home/temp", time.Time{}, now)
+	require.Len(t, samples, 2)
+	assert.Equal(t, Float(3), samples[0].Value)
+	assert.Equal(t, Float(1), samples[1].Value)
+}
+
+func TestPutBackdated(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{Size: 8}})
+
+	now := time.Now()
+	storage.PutMulti([]*Telemetry{newTelemetryAt("/home/temp", Float(22), now)})
+	storage.PutMulti([]*Telemetry{newTelemetryAt("/home/temp", Float(21), now.Add(-time.Minute))})
+
+	telemetries := storage.Read("/home/temp")
+	require.Len(t, telemetries, 1)
+	assert.Equal(t, Float(22), telemetries[0].Value)
+
+	// The history still records the backdated sample.
+	samples := storage.Range("/home/temp", now.Add(-time.Hour), now)
+	require.Len(t, samples, 2)
+	assert.Equal(t, Float(21), samples[0].Value)
+}
+
+func TestRangeMaxAge(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{MaxAge: 10 * time.Minute}})
+
+	now := time.Now()
+	for id := 0; id < 40; id++ {
+		storage.PutMulti([]*Telemetry{
+			newTelemetryAt("/home/temp", Float(float64(id)), now.Add(time.Duration(id-39)*time.Minute)),
+		})
+	}
+
+	samples := storage.Range("/home/temp", time.Time{}, now)
+	require.Len(t, samples, 10)
+	assert.Equal(t, Float(30), samples[0].Value)
+	assert.Equal(t, Float(39), samples[9].Value)
+}
+
+func TestReadWildcards(t *testing.T) {
+	storage := NewTelemetryStorage()
+	storage.PutMulti([]*Telemetry{
+		NewTelemetry("/home/temp", Float(21.5)),
+		NewTelemetry("/home/temperature_outdoor", Float(12)),
+		NewTelemetry("/home/kitchen/humidity", Float(40)),
+		NewTelemetry("/home/bathroom/humidity", Float(70)),
+		NewTelemetry("/home/bathroom/fan/humidity", Float(70)),
+	})
+
+	assert.Len(t, storage.Read("/home/temp"), 1)
+	assert.Len(t, storage.Read("/home/+/humidity"), 2)
+	assert.Len(t, storage.Read("/home/#"), 5)
+	assert.Len(t, storage.Read("#"), 5)
+	assert.Len(t, storage.Read("/home/bathroom/#"), 2)
+	assert.Empty(t, storage.Read("/home/#/humidity"))
+	assert.Len(t, storage.ReadPrefix("/home/temp"), 2)
+}
+
+func TestLabeledSeries(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{History: HistoryConfig{Size: 8}})
+
+	kitchen := NewTelemetry("/home/temp", Float(21.5))
+	kitchen.Labels = Labels{"room": "kitchen"}
+	bathroom := NewTelemetry("/home/temp", Float(25))
+	bathroom.Labels = Labels{"room": "bathroom"}
+
+	storage.PutMulti([]*Telemetry{kitchen, bathroom})
+
+	assert.Len(t, storage.Read("/home/temp"), 2)
+	assert.Equal(t, "/home/temp{room=kitchen}", kitchen.Key())
+
+	samples := storage.Range(kitchen.Key(), time.Time{}, time.Now())
+	require.Len(t, samples, 1)
+	assert.Equal(t, Float(21.5), samples[0].Value)
+}
+
+func TestParseSeries(t *testing.T) {
+	topic, labels, err := ParseSeries("/home/temp{sensor=a1, room=kitchen}")
+	require.NoError(t, err)
+	assert.Equal(t, "/home/temp", topic)
+	assert.Equal(t, Labels{"room": "kitchen", "sensor": "a1"}, labels)
+	assert.Equal(t, "{room=kitchen,sensor=a1}", labels.String())
+
+	topic, labels, err = ParseSeries("/home/temp")
+	require.NoError(t, err)
+	assert.Equal(t, "/home/temp", topic)
+	assert.Nil(t, labels)
+
+	for _, v := range []string{"/home/temp{room=kitchen", "/home/temp}", "{room=kitchen}", "/home/temp{room}"} {
+		_, _, err := ParseSeries(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestStaleness(t *testing.T) {
+	storage := newTelemetryStorage(t, Config{
+		Staleness: StalenessConfig{
+			MaxAge: 10 * time.Minute,
+			Rules: []*StalenessRule{
+				{Pattern: "/home/door/#", MaxAge: 0},
+				{Pattern: "/home/+/motion", MaxAge: time.Minute},
+			},
+		},
+	})
+
+	now := time.Now()
+	storage.PutMulti([]*Telemetry{
+		newTelemetryAt("/home/temp", Float(21), now.Add(-5*time.Minute)),
+		newTelemetryAt("/home/humidity", Float(40), now.Add(-15*time.Minute)),
+		newTelemetryAt("/home/door/front", Bool(true), now.Add(-24*time.Hour)),
+		newTelemetryAt("/home/kitchen/motion", Bool(true), now.Add(-2*time.Minute)),
+	})
+
+	stale := storage.Stale(now)
+	require.Len(t, stale, 2)
+
+	fresh := storage.Fresh(storage.Read("#"), now)
+	assert.Len(t, fresh, 2)
+
+	evicted := storage.EvictStale(now)
+	assert.Len(t, evicted, 2)
+	assert.Len(t, storage.Read("#"), 2)
+	assert.Empty(t, storage.Stale(now))
+}
+
+func TestStalenessInvalidPattern(t *testing.T) {
+	_, err := NewTelemetryStorageWithConfig(Config{
+		Staleness: StalenessConfig{
+			Rules: []*StalenessRule{{Pattern: "/home/#/temp", MaxAge: time.Minute}},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestStats(t *testing.T) {
+	storage := NewTelemetryStorage()
+
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(21)), NewTelemetry("/home/humidity", Float(40))})
+	storage.PutMulti([]*Telemetry{NewTelemetry("/home/temp", Float(22))})
+
+	assert.Equal(t, Stats{Puts: 3, Series: 2}, storage.Stats())
+}
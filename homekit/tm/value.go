@@ -0,0 +1,213 @@
+package tm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kind is a type of the telemetry value.
+type Kind int
+
+const (
+	KindFloat Kind = iota
+	KindInt
+	KindBool
+	KindString
+)
+
+func (m Kind) String() string {
+	switch m {
+	case KindFloat:
+		return "float"
+	case KindInt:
+		return "int"
+	case KindBool:
+		return "bool"
+	case KindString:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
+
+// TelemetryValue is a tagged telemetry value, which is either a float64,
+// an int64, a bool or a string.
+//
+// The zero value is a float zero.
+type TelemetryValue struct {
+	kind Kind
+	f    float64
+	i    int64
+	b    bool
+	s    string
+}
+
+func Float(v float64) TelemetryValue {
+	return TelemetryValue{kind: KindFloat, f: v}
+}
+
+func Int(v int64) TelemetryValue {
+	return TelemetryValue{kind: KindInt, i: v}
+}
+
+func Bool(v bool) TelemetryValue {
+	return TelemetryValue{kind: KindBool, b: v}
+}
+
+func String(v string) TelemetryValue {
+	return TelemetryValue{kind: KindString, s: v}
+}
+
+// NewTelemetryValue converts the given native Go value into a telemetry
+// value.
+func NewTelemetryValue(v interface{}) (TelemetryValue, error) {
+	switch v := v.(type) {
+	case TelemetryValue:
+		return v, nil
+	case float64:
+		return Float(v), nil
+	case float32:
+		return Float(float64(v)), nil
+	case int:
+		return Int(int64(v)), nil
+	case int64:
+		return Int(v), nil
+	case int32:
+		return Int(int64(v)), nil
+	case uint32:
+		return Int(int64(v)), nil
+	case bool:
+		return Bool(v), nil
+	case string:
+		return String(v), nil
+	default:
+		return TelemetryValue{}, fmt.Errorf("unsupported telemetry value type: %T", v)
+	}
+}
+
+func (m TelemetryValue) Kind() Kind {
+	return m.kind
+}
+
+// Float returns the value as a float64.
+//
+// Integers and booleans are converted, while strings are parsed, falling
+// back to zero.
+func (m TelemetryValue) Float() float64 {
+	v, _ := m.Numeric()
+	return v
+}
+
+// Numeric returns the numeric representation of the value, reporting
+// whether the value is numeric at all.
+//
+// Booleans are represented as 0 and 1.
+func (m TelemetryValue) Numeric() (float64, bool) {
+	switch m.kind {
+	case KindFloat:
+		return m.f, true
+	case KindInt:
+		return float64(m.i), true
+	case KindBool:
+		if m.b {
+			return 1, true
+		}
+		return 0, true
+	case KindString:
+		v, err := strconv.ParseFloat(m.s, 64)
+		if err != nil {
+			return 0, false
+		}
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// Int returns the value as an int64, truncating floats.
+func (m TelemetryValue) Int() int64 {
+	if m.kind == KindInt {
+		return m.i
+	}
+
+	return int64(m.Float())
+}
+
+// Bool returns the value as a bool, treating non-zero numbers as true.
+func (m TelemetryValue) Bool() bool {
+	switch m.kind {
+	case KindBool:
+		return m.b
+	case KindString:
+		v, _ := strconv.ParseBool(m.s)
+		return v
+	default:
+		return m.Float() != 0
+	}
+}
+
+// Interface returns the underlying native Go value.
+func (m TelemetryValue) Interface() interface{} {
+	switch m.kind {
+	case KindInt:
+		return m.i
+	case KindBool:
+		return m.b
+	case KindString:
+		return m.s
+	default:
+		return m.f
+	}
+}
+
+// String formats the value using the text format understood by
+// ParseTelemetryValue.
+func (m TelemetryValue) String() string {
+	switch m.kind {
+	case KindInt:
+		return strconv.FormatInt(m.i, 10) + "i"
+	case KindBool:
+		return strconv.FormatBool(m.b)
+	case KindString:
+		return strconv.Quote(m.s)
+	default:
+		return strconv.FormatFloat(m.f, 'g', -1, 64)
+	}
+}
+
+// ParseTelemetryValue parses the text representation of a telemetry
+// value, following the InfluxDB line protocol conventions:
+//   - "true" or "false" are booleans;
+//   - numbers with the "i" suffix, like "42i", are integers;
+//   - double-quoted strings, like "\"v1.2\"", are strings;
+//   - everything else is parsed as a float, except for NaN and infinities,
+//     which InfluxDB can not store.
+func ParseTelemetryValue(v string) (TelemetryValue, error) {
+	switch {
+	case v == "true" || v == "false":
+		return Bool(v == "true"), nil
+	case strings.HasPrefix(v, `"`):
+		s, err := strconv.Unquote(v)
+		if err != nil {
+			return TelemetryValue{}, fmt.Errorf("invalid string value %s: %v", v, err)
+		}
+		return String(s), nil
+	case strings.HasSuffix(v, "i"):
+		i, err := strconv.ParseInt(strings.TrimSuffix(v, "i"), 10, 64)
+		if err != nil {
+			return TelemetryValue{}, fmt.Errorf("invalid integer value %s: %v", v, err)
+		}
+		return Int(i), nil
+	default:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return TelemetryValue{}, fmt.Errorf("invalid float value %s: %v", v, err)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return TelemetryValue{}, fmt.Errorf("non-finite float value %s", v)
+		}
+		return Float(f), nil
+	}
+}
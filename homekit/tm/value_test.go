@@ -0,0 +1,55 @@
+package tm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTelemetryValue(t *testing.T) {
+	tests := []struct {
+		text  string
+		value TelemetryValue
+		kind  Kind
+	}{
+		{"21.5", Float(21.5), KindFloat},
+		{"-3", Float(-3), KindFloat},
+		{"42i", Int(42), KindInt},
+		{"-7i", Int(-7), KindInt},
+		{"true", Bool(true), KindBool},
+		{"false", Bool(false), KindBool},
+		{`"v1.2"`, String("v1.2"), KindString},
+		{`"heat;cool"`, String("heat;cool"), KindString},
+	}
+
+	for _, test := range tests {
+		value, err := ParseTelemetryValue(test.text)
+		require.NoError(t, err, test.text)
+		assert.Equal(t, test.value, value, test.text)
+		assert.Equal(t, test.kind, value.Kind(), test.text)
+
+		roundTrip, err := ParseTelemetryValue(value.String())
+		require.NoError(t, err, test.text)
+		assert.Equal(t, value, roundTrip, test.text)
+	}
+}
+
+func TestParseTelemetryValueInvalid(t *testing.T) {
+	for _, text := range []string{"", "abc", "4.2i", `"unterminated`, "True", "NaN", "Inf", "-Inf", "+inf", "1e400"} {
+		_, err := ParseTelemetryValue(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestTelemetryValueConversions(t *testing.T) {
+	assert.Equal(t, 1.0, Bool(true).Float())
+	assert.Equal(t, 42.0, Int(42).Float())
+	assert.Equal(t, int64(21), Float(21.5).Int())
+	assert.True(t, Float(0.5).Bool())
+	assert.Equal(t, int64(42), Int(42).Interface())
+	assert.Equal(t, "on", String("on").Interface())
+
+	_, ok := String("on").Numeric()
+	assert.False(t, ok)
+}